@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ANSIBLE_LOG_DIR = "/root/ansible-runs/"
+	// Replaces secrets in saved logs
+	REDACTED = "<redacted>"
+)
+
+var rxRecapLine = regexp.MustCompile(`^(\S+)\s*:\s*((?:\w+=\d+\s*)+)$`)
+
+// The join command and kubeadm bootstrap tokens are kept out of logs
+var (
+	rxJoinCommand  = regexp.MustCompile(`(join-command=)[^']*`)
+	rxKubeadmToken = regexp.MustCompile(`\b[a-z0-9]{6}\.[a-z0-9]{16}\b`)
+)
+
+// Counts of a single host from the PLAY RECAP
+type HostRecap struct {
+	Ok          int
+	Changed     int
+	Unreachable int
+	Failed      int
+	Skipped     int
+	Rescued     int
+	Ignored     int
+}
+
+/*
+AnsibleRun is the outcome of a single
+ansible command. Output holds the
+combined stdout and stderr and Log the
+file it was saved to.
+*/
+type AnsibleRun struct {
+	VmId        int
+	Kind        string
+	Command     []string
+	Started     time.Time
+	Duration    time.Duration
+	ExitCode    int
+	TimedOut    bool
+	Output      string
+	Log         string
+	Recap       map[string]HostRecap
+	Failed      int
+	Unreachable int
+}
+
+// One line description of the run
+func (r *AnsibleRun) Summary() string {
+	return fmt.Sprintf("%s of VM %d exited with %d after %s (failed=%d unreachable=%d timed out=%t), log: %s",
+		r.Kind, r.VmId, r.ExitCode, r.Duration.Round(time.Second), r.Failed, r.Unreachable, r.TimedOut, r.Log)
+}
+
+/*
+AnsibleRunError is returned when an
+ansible command does not succeed. The
+run carries the recap and output.
+*/
+type AnsibleRunError struct {
+	Run *AnsibleRun
+	Err error
+}
+
+func (e *AnsibleRunError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Run.Summary(), e.Err)
+}
+
+func (e *AnsibleRunError) Unwrap() error {
+	return e.Err
+}
+
+/*
+AnsibleRunner runs ansible commands with
+a timeout, captures their output and
+keeps the logs of the last Keep runs
+in LogDir. Retries, Backoff and
+OnTaskFailure control how failed
+playbooks are retried. The redacted
+output is streamed to Stdout, or to
+os.Stdout when it is nil.
+*/
+type AnsibleRunner struct {
+	Stdout        io.Writer
+	LogDir        string
+	Keep          int
+	Timeout       time.Duration
+	Retries       int
+	Backoff       time.Duration
+	OnTaskFailure string
+}
+
+// Serializes writing and pruning the run logs of all runners
+var ansibleLogMu sync.Mutex
+
+// Builds the ansible runner from the config
+func (c *Config) ansibleRunner() *AnsibleRunner {
+	return &AnsibleRunner{
+		LogDir:        ANSIBLE_LOG_DIR,
+		Keep:          c.AnsibleRunLogs,
+		Timeout:       time.Duration(c.AnsibleTimeout) * time.Second,
+		Retries:       c.AnsibleRetries,
+		Backoff:       time.Duration(c.AnsibleRetryBackoff) * time.Second,
+		OnTaskFailure: c.AnsibleOnTaskFailure,
+	}
+}
+
+/*
+run executes the command, streams its
+output to the pod log while capturing
+it and saves the run log. An
+AnsibleRunError is returned if the
+command fails or times out.
+*/
+func (r *AnsibleRunner) run(ctx context.Context, vmid int, kind string, command []string) (*AnsibleRun, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	run := &AnsibleRun{VmId: vmid, Kind: kind, Command: command, Started: time.Now()}
+	var output bytes.Buffer
+	stdout := r.Stdout
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	stream := &redactWriter{next: stdout}
+	writer := io.MultiWriter(stream, &output)
+	ColorPrint(INFO, "Executing: "+redact(strings.Join(command, " ")))
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	err := cmd.Run()
+	stream.Flush()
+
+	run.Duration = time.Since(run.Started)
+	run.Output = output.String()
+	run.ExitCode = cmd.ProcessState.ExitCode()
+	run.TimedOut = errors.Is(ctx.Err(), context.DeadlineExceeded)
+	run.Recap = parseRecap(run.Output)
+	for _, host := range run.Recap {
+		run.Failed += host.Failed
+		run.Unreachable += host.Unreachable
+	}
+	if logErr := r.save(run); logErr != nil {
+		ColorPrint(WARN, "Unable to save the ansible run log: %v", logErr)
+	}
+	if run.TimedOut {
+		err = fmt.Errorf("timed out after %s: %w", r.Timeout, err)
+	}
+	if err != nil {
+		return run, &AnsibleRunError{Run: run, Err: err}
+	}
+	ColorPrint(INFO, "Ansible %s", run.Summary())
+	return run, nil
+}
+
+/*
+parseRecap reads the per host counts
+from the PLAY RECAP at the end of the
+ansible output
+*/
+func parseRecap(output string) map[string]HostRecap {
+	recap := map[string]HostRecap{}
+	idx := strings.LastIndex(output, "PLAY RECAP")
+	if idx < 0 {
+		return recap
+	}
+	for _, line := range strings.Split(output[idx:], "\n")[1:] {
+		match := rxRecapLine.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		var host HostRecap
+		for _, field := range strings.Fields(match[2]) {
+			key, value, _ := strings.Cut(field, "=")
+			count, _ := strconv.Atoi(value)
+			switch key {
+			case "ok":
+				host.Ok = count
+			case "changed":
+				host.Changed = count
+			case "unreachable":
+				host.Unreachable = count
+			case "failed":
+				host.Failed = count
+			case "skipped":
+				host.Skipped = count
+			case "rescued":
+				host.Rescued = count
+			case "ignored":
+				host.Ignored = count
+			}
+		}
+		recap[match[1]] = host
+	}
+	return recap
+}
+
+// Hides the join command and bootstrap tokens in text that is logged
+func redact(text string) string {
+	text = rxJoinCommand.ReplaceAllString(text, "${1}"+REDACTED)
+	return rxKubeadmToken.ReplaceAllString(text, REDACTED)
+}
+
+/*
+redactWriter passes whole lines through
+redact before writing them, so secrets
+split across writes are still caught.
+Flush writes a last unterminated line.
+*/
+type redactWriter struct {
+	mu   sync.Mutex
+	next io.Writer
+	line []byte
+}
+
+func (w *redactWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.line = append(w.line, p...)
+	for {
+		end := bytes.IndexByte(w.line, '\n')
+		if end < 0 {
+			return len(p), nil
+		}
+		if _, err := io.WriteString(w.next, redact(string(w.line[:end+1]))); err != nil {
+			return len(p), err
+		}
+		w.line = w.line[end+1:]
+	}
+}
+
+func (w *redactWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.line) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(w.next, redact(string(w.line)))
+	w.line = nil
+	return err
+}
+
+/*
+save writes the command and output of
+the run to the log directory and
+removes the oldest logs beyond Keep.
+Secrets are redacted and the log is
+only readable by its owner.
+*/
+func (r *AnsibleRunner) save(run *AnsibleRun) error {
+	ansibleLogMu.Lock()
+	defer ansibleLogMu.Unlock()
+	if err := os.MkdirAll(r.LogDir, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%d-%s.log", run.Started.UTC().Format("20060102T150405.000"), run.VmId, run.Kind)
+	run.Log = filepath.Join(r.LogDir, name)
+	content := redact("$ " + strings.Join(run.Command, " ") + "\n" + run.Output)
+	if err := os.WriteFile(run.Log, []byte(content), 0600); err != nil {
+		return err
+	}
+
+	logs, err := filepath.Glob(filepath.Join(r.LogDir, "*.log"))
+	if err != nil {
+		return err
+	}
+	// Names start with the time so they sort oldest first
+	sort.Strings(logs)
+	for len(logs) > r.Keep {
+		if err := os.Remove(logs[0]); err != nil {
+			return err
+		}
+		logs = logs[1:]
+	}
+	return nil
+}
+
+/*
+Classes of failed ansible runs that
+decide how a playbook is retried
+*/
+const (
+	ANSIBLE_FAILURE_TIMEOUT     = "timeout"
+	ANSIBLE_FAILURE_TASK        = "task"
+	ANSIBLE_FAILURE_UNREACHABLE = "unreachable"
+	ANSIBLE_FAILURE_OTHER       = "other"
+)
+
+/*
+What to do when a task of the playbook
+fails. The VM is rolled back, the
+playbook is run again or it resumes at
+the task that failed.
+*/
+const (
+	ANSIBLE_ON_TASK_FAILURE_ROLLBACK = "rollback"
+	ANSIBLE_ON_TASK_FAILURE_RETRY    = "retry"
+	ANSIBLE_ON_TASK_FAILURE_RESUME   = "resume"
+)
+
+var rxTaskHeader = regexp.MustCompile(`^TASK \[(.+)\]`)
+
+// Returns the class of a failed run
+func (r *AnsibleRun) FailureClass() string {
+	switch {
+	case r.TimedOut:
+		return ANSIBLE_FAILURE_TIMEOUT
+	case r.Failed > 0:
+		return ANSIBLE_FAILURE_TASK
+	case r.Unreachable > 0:
+		return ANSIBLE_FAILURE_UNREACHABLE
+	}
+	return ANSIBLE_FAILURE_OTHER
+}
+
+/*
+FailedTask returns the name of the last
+task that failed in the run, or "" if
+the output does not show one. Failures
+ansible reports as ignored do not
+count.
+*/
+func (r *AnsibleRun) FailedTask() string {
+	task := ""
+	failed := ""
+	previous := ""
+	for _, line := range strings.Split(r.Output, "\n") {
+		if match := rxTaskHeader.FindStringSubmatch(line); match != nil {
+			task = match[1]
+		} else if strings.HasPrefix(line, "fatal:") || strings.HasPrefix(line, "failed:") {
+			previous, failed = failed, task
+		} else if strings.TrimSpace(line) == "...ignoring" {
+			failed = previous
+		}
+	}
+	return failed
+}
+
+/*
+PlaybookWithRetries runs the playbook and
+retries it up to Retries times with a
+doubling Backoff. Timeouts are never
+retried. Unreachable hosts are retried
+once ssh answers on address again.
+Failed tasks are handled as set in
+OnTaskFailure and other failures are
+retried as they are.
+*/
+func (r *AnsibleRunner) PlaybookWithRetries(ctx context.Context, vmid int, address string, playbook string, vars string, user string, joinCommand string, inventory string) (*AnsibleRun, error) {
+	startAt := ""
+	backoff := r.Backoff
+	for attempt := 1; ; attempt++ {
+		run, err := r.Playbook(ctx, vmid, playbook, vars, user, joinCommand, inventory, startAt)
+		if err == nil || run == nil || ctx.Err() != nil || attempt > r.Retries {
+			return run, err
+		}
+
+		class := run.FailureClass()
+		ColorPrint(WARN, "Ansible playbook of VM %d failed with a %s failure: %v", vmid, class, err)
+		switch class {
+		case ANSIBLE_FAILURE_TIMEOUT:
+			return run, err
+		case ANSIBLE_FAILURE_TASK:
+			switch r.OnTaskFailure {
+			case ANSIBLE_ON_TASK_FAILURE_ROLLBACK:
+				return run, err
+			case ANSIBLE_ON_TASK_FAILURE_RESUME:
+				startAt = run.FailedTask()
+			}
+		case ANSIBLE_FAILURE_UNREACHABLE:
+			if sshErr := waitForSSH(ctx, address); sshErr != nil {
+				return run, fmt.Errorf("%w; ssh did not come back: %v", err, sshErr)
+			}
+		}
+
+		if len(startAt) != 0 {
+			ColorPrint(WARN, "Resuming the playbook at task '%s' in %s (retry %d of %d)", startAt, backoff, attempt, r.Retries)
+		} else {
+			ColorPrint(WARN, "Running the playbook again in %s (retry %d of %d)", backoff, attempt, r.Retries)
+		}
+		select {
+		case <-ctx.Done():
+			return run, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// Waits until the ssh port of the address accepts connections
+func waitForSSH(ctx context.Context, address string) error {
+	var dialer net.Dialer
+	return retryWithBackoff(ctx, fmt.Sprintf("Waiting for ssh on %s", address), func() error {
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(address, "22"))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const TEST_PLAY_RECAP = `TASK [kubeadm : Join the node to the cluster] **********************************
+changed: [k8s-default-120]
+fatal: [k8s-default-121]: UNREACHABLE! => {"changed": false, "msg": "Failed to connect to the host via ssh: ssh: connect to host 10.0.0.121 port 22: No route to host", "unreachable": true}
+
+PLAY RECAP *********************************************************************
+k8s-default-120            : ok=12   changed=7    unreachable=0    failed=1    skipped=3    rescued=1    ignored=2   
+k8s-default-121            : ok=0    changed=0    unreachable=1    failed=0    skipped=0    rescued=0    ignored=0   
+10.0.0.122                 : ok=4    changed=1    unreachable=0    failed=0    skipped=0    rescued=0    ignored=0   
+
+`
+
+func TestParseRecap(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   map[string]HostRecap
+	}{
+		{"multiple hosts", TEST_PLAY_RECAP, map[string]HostRecap{
+			"k8s-default-120": {Ok: 12, Changed: 7, Failed: 1, Skipped: 3, Rescued: 1, Ignored: 2},
+			"k8s-default-121": {Unreachable: 1},
+			"10.0.0.122":      {Ok: 4, Changed: 1},
+		}},
+		{"last recap wins", "PLAY RECAP ***\nold : ok=1 failed=1\n\nPLAY [second] ***\n\nPLAY RECAP ***\nnew : ok=2 failed=0\n", map[string]HostRecap{
+			"new": {Ok: 2},
+		}},
+		{"missing recap", "ERROR! the playbook: /root/repo/site.yml could not be found\n", map[string]HostRecap{}},
+		{"no output", "", map[string]HostRecap{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRecap(tt.output); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseRecap() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSaveKeepsNewestLogs(t *testing.T) {
+	runner := &AnsibleRunner{LogDir: t.TempDir(), Keep: 2}
+	started := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	var saved []string
+	for i := 0; i < 4; i++ {
+		run := &AnsibleRun{VmId: 120 + i, Kind: "playbook", Command: []string{"ansible-playbook", "site.yml"}, Started: started.Add(time.Duration(i) * time.Second)}
+		if err := runner.save(run); err != nil {
+			t.Fatal(err)
+		}
+		saved = append(saved, run.Log)
+	}
+	logs, err := filepath.Glob(filepath.Join(runner.LogDir, "*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(logs, saved[2:]) {
+		t.Fatalf("logs = %v, want the newest two %v", logs, saved[2:])
+	}
+}
+
+func TestSaveRedactsJoinCommand(t *testing.T) {
+	var stdout bytes.Buffer
+	runner := &AnsibleRunner{Stdout: &stdout, LogDir: t.TempDir(), Keep: 5, Timeout: time.Minute}
+	join := "kubeadm join 10.0.0.10:6443 --token abcdef.0123456789abcdef --discovery-token-ca-cert-hash sha256:1234"
+	run, err := runner.run(context.Background(), 120, "playbook", []string{"echo", "-e", "'join-command=" + join + "'", "cmd: " + join})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(run.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Fatalf("log is written with mode %o, want 600", mode)
+	}
+	content, err := os.ReadFile(run.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "abcdef.0123456789abcdef") {
+		t.Fatalf("log contains the bootstrap token:\n%s", content)
+	}
+	if !strings.Contains(string(content), "'join-command="+REDACTED+"'") {
+		t.Fatalf("log does not show the redacted join command:\n%s", content)
+	}
+	if streamed := stdout.String(); strings.Contains(streamed, "abcdef.0123456789abcdef") || !strings.Contains(streamed, "join-command="+REDACTED) {
+		t.Fatalf("streamed output is not redacted:\n%s", streamed)
+	}
+}
+
+/*
+Secrets split across writes are still
+redacted, and an unterminated last line
+is written by Flush.
+*/
+func TestRedactWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := &redactWriter{next: &out}
+	for _, chunk := range []string{"ok: [k8s] => {\"cmd\": \"kubeadm join --token abc", "def.0123456789abcdef\"}\n", "changed: [k8s]\nlast line"} {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if strings.Contains(out.String(), "last line") {
+		t.Fatal("an unterminated line was written before Flush")
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := "ok: [k8s] => {\"cmd\": \"kubeadm join --token " + REDACTED + "\"}\nchanged: [k8s]\nlast line"
+	if out.String() != want {
+		t.Fatalf("written %q, want %q", out.String(), want)
+	}
+}
+
+func TestFailureClass(t *testing.T) {
+	tests := []struct {
+		name string
+		run  AnsibleRun
+		want string
+	}{
+		{"timeout wins over failed tasks", AnsibleRun{TimedOut: true, Failed: 1, Unreachable: 1}, ANSIBLE_FAILURE_TIMEOUT},
+		{"failed task", AnsibleRun{Failed: 1}, ANSIBLE_FAILURE_TASK},
+		{"failed task and unreachable host", AnsibleRun{Failed: 1, Unreachable: 1}, ANSIBLE_FAILURE_TASK},
+		{"unreachable only", AnsibleRun{Unreachable: 2}, ANSIBLE_FAILURE_UNREACHABLE},
+		{"no recap", AnsibleRun{ExitCode: 4}, ANSIBLE_FAILURE_OTHER},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.run.FailureClass(); got != tt.want {
+				t.Fatalf("FailureClass() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFailedTask(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   string
+	}{
+		{"fatal", `TASK [Gathering Facts] *********************************************************
+ok: [k8s-default-120]
+
+TASK [Install containerd] ******************************************************
+fatal: [k8s-default-120]: FAILED! => {"changed": false, "msg": "No package matching 'containerd.io' is available"}
+`, "Install containerd"},
+		{"failed loop item", `TASK [Install packages] ********************************************************
+ok: [k8s-default-120] => (item=curl)
+failed: [k8s-default-120] (item=kubelet) => {"ansible_loop_var": "item", "changed": false, "item": "kubelet", "msg": "No package matching 'kubelet' is available"}
+`, "Install packages"},
+		{"role prefix", `TASK [containerd : Configure containerd] ***************************************
+changed: [k8s-default-120]
+
+TASK [kubeadm : Join the node to the cluster] **********************************
+fatal: [k8s-default-120]: FAILED! => {"changed": true, "cmd": ["sh", "/tmp/join-command.sh"], "rc": 1}
+`, "kubeadm : Join the node to the cluster"},
+		{"last failure wins", `TASK [Pull images] *************************************************************
+fatal: [k8s-default-121]: FAILED! => {"changed": false, "msg": "timeout"}
+
+TASK [kubeadm : Join the node to the cluster] **********************************
+fatal: [k8s-default-120]: FAILED! => {"changed": true, "rc": 1}
+`, "kubeadm : Join the node to the cluster"},
+		{"ignored failure", `TASK [Join the node to the cluster] ********************************************
+fatal: [k8s-default-120]: FAILED! => {"changed": true, "rc": 1}
+
+TASK [Remove the old kubelet config] *******************************************
+fatal: [k8s-default-121]: FAILED! => {"changed": false, "msg": "file not found"}
+...ignoring
+`, "Join the node to the cluster"},
+		{"unreachable", `TASK [Gathering Facts] *********************************************************
+fatal: [k8s-default-120]: UNREACHABLE! => {"changed": false, "msg": "Failed to connect to the host via ssh", "unreachable": true}
+`, "Gathering Facts"},
+		{"no failed task", "TASK [Gathering Facts] ***\nok: [k8s-default-120]\n", ""},
+		{"failure before any task", "ERROR! couldn't resolve module/action 'kubernetes.core.k8s'\nfatal: unexpected\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run := AnsibleRun{Output: tt.output}
+			if got := run.FailedTask(); got != tt.want {
+				t.Fatalf("FailedTask() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// What the fake ansible-playbook prints and exits with on one attempt
+type fakeAttempt struct {
+	output string
+	exit   string
+}
+
+const (
+	TEST_RECAP_OK          = "PLAY RECAP ***\nk8s-default-120 : ok=9 changed=3 unreachable=0 failed=0 skipped=0 rescued=0 ignored=0\n"
+	TEST_RECAP_FAILED      = "TASK [kubeadm : Join the node to the cluster] ***\nfatal: [k8s-default-120]: FAILED! => {\"rc\": 1}\n\nPLAY RECAP ***\nk8s-default-120 : ok=5 changed=1 unreachable=0 failed=1 skipped=0 rescued=0 ignored=0\n"
+	TEST_RECAP_UNREACHABLE = "TASK [Gathering Facts] ***\nfatal: [k8s-default-120]: UNREACHABLE! => {\"unreachable\": true}\n\nPLAY RECAP ***\nk8s-default-120 : ok=0 changed=0 unreachable=1 failed=0 skipped=0 rescued=0 ignored=0\n"
+)
+
+/*
+fakeAnsible puts an ansible-playbook on
+PATH that plays the attempts in order,
+repeating the last one, and returns the
+file its arguments are recorded in.
+*/
+func fakeAnsible(t *testing.T, attempts []fakeAttempt) string {
+	dir := t.TempDir()
+	for i, attempt := range attempts {
+		for _, name := range []string{strconv.Itoa(i + 1), "last"} {
+			if name == "last" && i != len(attempts)-1 {
+				continue
+			}
+			if err := os.WriteFile(filepath.Join(dir, "out"+name), []byte(attempt.output), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "exit"+name), []byte(attempt.exit), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	script := `#!/bin/sh
+dir=$(dirname "$0")
+echo "$@" >> "$dir/args"
+n=$(wc -l < "$dir/args" | tr -d ' ')
+[ -f "$dir/exit$n" ] || n=last
+cat "$dir/out$n"
+code=$(cat "$dir/exit$n")
+[ "$code" = hang ] && exec sleep 5
+exit "$code"
+`
+	if err := os.WriteFile(filepath.Join(dir, "ansible-playbook"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return filepath.Join(dir, "args")
+}
+
+func TestPlaybookWithRetries(t *testing.T) {
+	failed := fakeAttempt{TEST_RECAP_FAILED, "2"}
+	tests := []struct {
+		name          string
+		attempts      []fakeAttempt
+		retries       int
+		onTaskFailure string
+		timeout       time.Duration
+		address       string
+		wantRuns      int
+		wantErr       string
+		wantStartAt   string
+	}{
+		{"success", []fakeAttempt{{TEST_RECAP_OK, "0"}}, 2, ANSIBLE_ON_TASK_FAILURE_RETRY, 0, "", 1, "", ""},
+		{"no retries", []fakeAttempt{failed}, 0, ANSIBLE_ON_TASK_FAILURE_RETRY, 0, "", 1, "exited with 2", ""},
+		{"retries run out", []fakeAttempt{failed}, 2, ANSIBLE_ON_TASK_FAILURE_RETRY, 0, "", 3, "exited with 2", ""},
+		{"last retry succeeds", []fakeAttempt{failed, failed, {TEST_RECAP_OK, "0"}}, 2, ANSIBLE_ON_TASK_FAILURE_RETRY, 0, "", 3, "", ""},
+		{"task failure rolls back", []fakeAttempt{failed}, 2, ANSIBLE_ON_TASK_FAILURE_ROLLBACK, 0, "", 1, "failed=1", ""},
+		{"task failure resumes", []fakeAttempt{failed, {TEST_RECAP_OK, "0"}}, 2, ANSIBLE_ON_TASK_FAILURE_RESUME, 0, "", 2, "", "kubeadm : Join the node to the cluster"},
+		{"timeout is not retried", []fakeAttempt{{"TASK [Pull images] ***\n", "hang"}}, 2, ANSIBLE_ON_TASK_FAILURE_RETRY, 200 * time.Millisecond, "", 1, "timed out", ""},
+		{"unreachable waits for ssh", []fakeAttempt{{TEST_RECAP_UNREACHABLE, "4"}}, 2, ANSIBLE_ON_TASK_FAILURE_RETRY, 0, "192.0.2.1", 1, "ssh did not come back", ""},
+		{"other failure is retried", []fakeAttempt{{"ERROR! the playbook: site.yml could not be found\n", "1"}, {TEST_RECAP_OK, "0"}}, 1, ANSIBLE_ON_TASK_FAILURE_ROLLBACK, 0, "", 2, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := fakeAnsible(t, tt.attempts)
+			runner := &AnsibleRunner{LogDir: t.TempDir(), Keep: 10, Timeout: time.Minute, Retries: tt.retries, Backoff: time.Millisecond, OnTaskFailure: tt.onTaskFailure}
+			if tt.timeout != 0 {
+				runner.Timeout = tt.timeout
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			run, err := runner.PlaybookWithRetries(ctx, 120, tt.address, "site.yml", "", "root", "", "/root/hosts-120")
+			if len(tt.wantErr) == 0 && err != nil {
+				t.Fatalf("PlaybookWithRetries() = %v", err)
+			}
+			if len(tt.wantErr) != 0 && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("PlaybookWithRetries() = %v, want an error containing %q", err, tt.wantErr)
+			}
+			if run == nil {
+				t.Fatal("PlaybookWithRetries() returned no run")
+			}
+			recorded, err := os.ReadFile(args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			calls := strings.Split(strings.TrimSpace(string(recorded)), "\n")
+			if len(calls) != tt.wantRuns {
+				t.Fatalf("playbook ran %d times, want %d", len(calls), tt.wantRuns)
+			}
+			last := calls[len(calls)-1]
+			_, startAt, resumed := strings.Cut(last, "--start-at-task ")
+			if startAt != tt.wantStartAt || resumed != (len(tt.wantStartAt) != 0) {
+				t.Fatalf("last run %q resumed at %q, want %q", last, startAt, tt.wantStartAt)
+			}
+		})
+	}
+}
@@ -1,48 +1,54 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"os"
-	"os/exec"
+	"strconv"
 	"strings"
+
+	"github.com/relex/aini"
 )
 
 /*
 AnsibleGalaxy executes ansible-galaxy collection install
 using the requirements filepath passed
 Expects ansible binary to be present
-in PATH
+in PATH. Nothing is run and nil is
+returned without a requirements file.
 */
-func AnsibleGalaxy(requirements string) {
-	if len(requirements) > 0 {
-		cmd0 := "ansible-galaxy"
-		cmd1 := "collection"
-		cmd2 := "install"
-		cmd3 := "-r"
-		cmd4 := strings.Trim(requirements, "\n")
-		cmd := exec.Command(cmd0, cmd1, cmd2, cmd3, cmd4)
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err := cmd.Run()
-		FailError(err)
-
-		ColorPrint(INFO, "Finished installing ansible requirements")
-	} else {
+func (r *AnsibleRunner) Galaxy(ctx context.Context, requirements string) (*AnsibleRun, error) {
+	if len(requirements) == 0 {
 		ColorPrint(WARN, "Requirements file was not proivded! Skipping requirements installation for ansible")
+		return nil, nil
 	}
+	cmd0 := "ansible-galaxy"
+	cmd1 := "collection"
+	cmd2 := "install"
+	cmd3 := "-r"
+	cmd4 := strings.Trim(requirements, "\n")
+	run, err := r.run(ctx, 0, "galaxy", []string{cmd0, cmd1, cmd2, cmd3, cmd4})
+	if err == nil {
+		ColorPrint(INFO, "Finished installing ansible requirements")
+	}
+	return run, err
 }
 
 /*
 AnsiblePlaybook executes ansible-playbook
-using the playbook filepath passed
-Expects ansible binary to be present
-in PATH
+for a VM using the playbook filepath
+passed. Expects ansible binary to be
+present in PATH. A non empty startAt
+skips the tasks before the task with
+that name. The playbook is killed once
+ctx is done or the timeout of the
+runner expires.
 */
-func AnsiblePlaybook(playbook string, vars string, user string, joinCommand string) error {
+func (r *AnsibleRunner) Playbook(ctx context.Context, vmid int, playbook string, vars string, user string, joinCommand string, inventory string, startAt string) (*AnsibleRun, error) {
 	cmd0 := "ansible-playbook"
 	cmd1 := strings.Trim(playbook, "\n")
 	cmd2 := "-i"
-	cmd3 := "/root/hosts"
+	cmd3 := inventory
 	cmd4 := "--user"
 	cmd5 := strings.Trim(user, "\n")
 	cmd6 := "--private-key"
@@ -51,7 +57,6 @@ func AnsiblePlaybook(playbook string, vars string, user string, joinCommand stri
 	cmd9 := "-o StrictHostKeyChecking=no"
 	cmd10 := "-e"
 
-	var cmd *exec.Cmd
 	command := []string{cmd0, cmd1, cmd2, cmd3, cmd4, cmd5, cmd8, cmd9, cmd6, cmd7}
 	if len(vars) > 0 {
 		cmd11 := "@" + REPO_LOCATION + strings.Trim(vars, "\n")
@@ -71,26 +76,39 @@ func AnsiblePlaybook(playbook string, vars string, user string, joinCommand stri
 	if len(joinCommand) != 0 {
 		cmd12 := "'join-command=" + strings.Trim(joinCommand, "\n") + "'"
 		command = append(command, cmd10, cmd12)
-		generateJoinFile(joinCommand, playbook[:+strings.LastIndex(playbook, "/")+1])
+		if err := generateJoinFile(joinCommand, playbook[:+strings.LastIndex(playbook, "/")+1]); err != nil {
+			return nil, err
+		}
 	}
-
-	ColorPrint(INFO, "Executing: "+strings.Join(command, " "))
-	cmd = exec.Command(command[0], command[1:]...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	if len(startAt) != 0 {
+		command = append(command, "--start-at-task", startAt)
+	}
+	return r.run(ctx, vmid, "playbook", command)
 }
 
-func generateAnsibleInventory(ipAddr string, ansibleTag string, hostName string, sshUser string) {
+func generateAnsibleInventory(ipAddr string, ansibleTag string, hostName string, sshUser string, inventory string) error {
 	// Assuming SSH port is 22
 	d1 := []byte("[" + strings.Trim(ansibleTag, "\n") + "]\n" + hostName + " ansible_host=" + ipAddr + " ansible_port=22 ansible_user=" + sshUser + "\n")
-	err := os.WriteFile(INVENTORY_PATH, d1, 0644)
-	FailError(err)
+	return os.WriteFile(inventory, d1, 0644)
+}
+
+// Checks that the inventory at path can be parsed
+func parseAnsibleInventory(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = aini.Parse(bufio.NewReader(file))
+	return err
+}
+
+// Returns the inventory path used for a single VM
+func inventoryPath(vmid int) string {
+	return INVENTORY_PATH + "-" + strconv.Itoa(vmid)
 }
 
-func generateJoinFile(joinCommand string, folderPath string) {
+func generateJoinFile(joinCommand string, folderPath string) error {
 	d1 := []byte(strings.Trim(joinCommand, "\n"))
-	err := os.WriteFile(folderPath+"join-command", d1, 0644)
-	FailError(err)
+	return os.WriteFile(folderPath+"join-command", d1, 0644)
 }
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	metrics "k8s.io/metrics/pkg/client/clientset/versioned"
+)
+
+/*
+Autoscaler bundles the clients and
+config shared by the main loop and
+the operator subcommands.
+*/
+type Autoscaler struct {
+	cfg       *Config
+	clients   map[string]*proxmox.Client
+	connStr   string
+	clientset kubernetes.Interface
+	metrics   *metrics.Clientset
+	events    *EventRecorder
+	status    *AutoscalerStatus
+	listVms   func() ([]VmRecord, error)
+
+	// Why clusters can not take new VMs
+	unavailable map[string]string
+
+	// Guards cfg, clients and unavailable, which are swapped on reloads
+	cfgMu sync.RWMutex
+
+	// Shared by concurrent provisioning
+	vmids        *VmidAllocator
+	reservations *Reservations
+	proxmoxSlots chan struct{}
+	repoMu       sync.Mutex
+	statusMu     sync.Mutex
+	statusWrite  *time.Timer
+}
+
+/*
+NewAutoscaler validates the config and
+creates the proxmox, postgres and
+in-cluster kubernetes clients.
+*/
+func NewAutoscaler() *Autoscaler {
+	// Validate the proxmox setup
+	cfg, err := loadConfig()
+	FailError(err)
+	*proxmox.Debug = cfg.Debug
+	clients := CreateClients(cfg)
+
+	// Validate postgres setup
+	connStr := validatePostgresConfig()
+
+	// creates the in-cluster config
+	config, err := rest.InClusterConfig()
+	FailError(err)
+	// creates the clientset
+	clientset, err := kubernetes.NewForConfig(config)
+	FailError(err)
+
+	mc, err := metrics.NewForConfig(config)
+	FailError(err)
+
+	return &Autoscaler{
+		cfg:       cfg,
+		clients:   clients,
+		connStr:   connStr,
+		clientset: clientset,
+		metrics:   mc,
+		events:    NewEventRecorder(clientset),
+		status:    NewAutoscalerStatus(),
+		listVms:   func() ([]VmRecord, error) { return ListVmInfo(connStr) },
+
+		vmids:        NewVmidAllocator(),
+		reservations: NewReservations(),
+		proxmoxSlots: make(chan struct{}, cfg.MaxProxmoxRequests),
+	}
+}
+
+// Writes the queued kubernetes events before the process exits
+func (a *Autoscaler) Close() {
+	a.events.Flush()
+}
+
+/*
+ApplyConfig swaps in a reloaded config
+and re-creates the proxmox client if
+its connection settings changed.
+Changed node groups get their
+templates validated again. Clusters
+that could not be reached are retried.
+*/
+func (a *Autoscaler) ApplyConfig(next *Config) {
+	current := a.config()
+	if next == current {
+		a.connectClusters()
+		return
+	}
+	clients := a.proxmoxClients()
+	clientChanged := next.clientChanged(current)
+	if clientChanged {
+		ColorPrint(INFO, "Proxmox connection settings changed. Re-creating the clients...")
+		clients = CreateClients(next)
+	}
+	*proxmox.Debug = next.Debug
+	templatesChanged := !reflect.DeepEqual(next.NodeGroups, current.NodeGroups) || !reflect.DeepEqual(next.Clusters, current.Clusters)
+	a.cfgMu.Lock()
+	a.cfg = next
+	a.clients = clients
+	a.cfgMu.Unlock()
+	if clientChanged || templatesChanged {
+		if err := a.checkClusters(); err != nil {
+			ColorPrint(WARN, "Reloaded config has no usable proxmox cluster: %v", err)
+		}
+	}
+	if !clientChanged {
+		a.connectClusters()
+	}
+}
+
+// Returns the config in use
+func (a *Autoscaler) config() *Config {
+	a.cfgMu.RLock()
+	defer a.cfgMu.RUnlock()
+	return a.cfg
+}
+
+// Returns the clients of the reachable proxmox clusters
+func (a *Autoscaler) proxmoxClients() map[string]*proxmox.Client {
+	a.cfgMu.RLock()
+	defer a.cfgMu.RUnlock()
+	return a.clients
+}
+
+/*
+Utilization calculates the overall
+cpu and mem usage of the cluster
+using the metrics server.
+*/
+func (a *Autoscaler) Utilization() (float32, float32) {
+	//Get all nodes
+	nodes, err := a.clientset.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
+	FailError(err)
+
+	// Loop through all nodes and find allocatable cpu & mem along with usage
+	var overall_cpu_percentage, overall_mem_percentage float32 = 0.00, 0.00
+	var usage []NodeUtilization
+	for node_index := range nodes.Items {
+		name := nodes.Items[node_index].Name
+		total_cpu := nodes.Items[node_index].Status.Allocatable.Cpu().MilliValue()
+		total_mem := nodes.Items[node_index].Status.Allocatable.Memory()
+		metric_values, err := a.metrics.MetricsV1beta1().NodeMetricses().Get(context.TODO(), name, metav1.GetOptions{})
+		FailError(err)
+		used_mem := metric_values.Usage.Memory()
+		used_cpu := metric_values.Usage.Cpu().MilliValue()
+		ColorPrint(INFO, "Node %s is using %s/%s mem and %d/%d cpu\n", name, used_mem, total_mem, used_cpu, total_cpu)
+		cpu_percentage := percentage(used_cpu, total_cpu)
+		mem_percentage := percentage(used_mem.MilliValue(), total_mem.MilliValue())
+		usage = append(usage, NodeUtilization{
+			Name:     name,
+			UsedCpu:  used_cpu,
+			TotalCpu: total_cpu,
+			CpuUsage: cpu_percentage,
+			UsedMem:  used_mem.String(),
+			TotalMem: total_mem.String(),
+			MemUsage: mem_percentage,
+		})
+
+		overall_cpu_percentage += cpu_percentage
+		overall_mem_percentage += mem_percentage
+	}
+	if len(nodes.Items) != 0 {
+		overall_cpu_percentage = overall_cpu_percentage / float32(len(nodes.Items))
+		overall_mem_percentage = overall_mem_percentage / float32(len(nodes.Items))
+	}
+	ColorPrint(INFO, "Overall cpu usage: %f and overall mem usage: %f\n", overall_cpu_percentage, overall_mem_percentage)
+	a.status.SetUtilization(usage, overall_cpu_percentage, overall_mem_percentage)
+	return overall_cpu_percentage, overall_mem_percentage
+}
+
+// Returns used as a percentage of total, 0 if total is 0
+func percentage(used int64, total int64) float32 {
+	if total == 0 {
+		return 0
+	}
+	return float32(100 * float64(used) / float64(total))
+}
+
+/*
+Reconcile runs a single autoscaling
+cycle. A new VM is created in the
+default group if any one of the
+overall thresholds are exceeded or
+if force is set.
+*/
+func (a *Autoscaler) Reconcile(ctx context.Context, force bool) {
+	cfg := a.config()
+	cpuUsage, memUsage := a.Utilization()
+	if cpuUsage <= float32(cfg.CpuLimit) && memUsage <= float32(cfg.MemoryLimit) && !force {
+		return
+	}
+	group := cfg.Group(DEFAULT_GROUP)
+
+	// Only report what would be done in dry-run mode
+	if cfg.DryRun {
+		PlanScaleUp(a.placementClients(), cfg, group, cfg.ScaleUpStep, cpuUsage, memUsage)
+		return
+	}
+	a.events.Deployment(v1.EventTypeNormal, EVENT_SCALE_UP_TRIGGERED, "Scaling up group '%s': overall cpu usage %f and mem usage %f (limits: %d, %d)", group.Name, cpuUsage, memUsage, cfg.CpuLimit, cfg.MemoryLimit)
+	a.events.PendingPods(v1.EventTypeNormal, EVENT_TRIGGERED_SCALE_UP, "Pod triggered scale-up of group '%s'", group.Name)
+	a.Provision(ctx, group, cfg.ScaleUpStep)
+}
+
+/*
+ScaleUp clones, starts and joins a
+single new VM from the node group
+into the cluster. Progress and the
+result are published in the status
+ConfigMap.
+*/
+func (a *Autoscaler) ScaleUp(ctx context.Context, group *NodeGroup) error {
+	return a.scaleUpTracked(ctx, group, a.status.StartProvisioning(group.Name))
+}
+
+// Scales up a VM that was already registered as in flight with id
+func (a *Autoscaler) scaleUpTracked(ctx context.Context, group *NodeGroup, id int) error {
+	err := a.scaleUp(ctx, group, id)
+	a.status.FinishProvisioning(id)
+	if err != nil {
+		a.status.ScaleUpDone(fmt.Sprintf("Failed for group %s: %v", group.Name, err))
+	} else {
+		a.status.ScaleUpDone("Succeeded for group " + group.Name)
+	}
+	a.WriteStatus()
+	return err
+}
+
+func (a *Autoscaler) scaleUp(ctx context.Context, group *NodeGroup, id int) (err error) {
+	// Clone repo for ansible if config is provided
+	cfg := a.config()
+	ansibleTag := cfg.AnsibleTag
+	ansibleRepo := cfg.AnsibleRepo
+	var playbookLocation string
+	runAnsiblePlaybook := false
+	if len(ansibleTag) != 0 && len(ansibleRepo) != 0 {
+		runAnsiblePlaybook = true
+		ColorPrint(INFO, "Ansible Tag and Repo were provided in the configuration: %s", ansibleTag)
+		ColorPrint(INFO, "Attempting to configure this new VM with the ansible config provided.")
+		a.repoMu.Lock()
+		err := CloneRepo(ansibleRepo)
+		a.repoMu.Unlock()
+		if err != nil {
+			return err
+		}
+		ansiblePlaybook := cfg.AnsiblePlaybook
+		if len(ansiblePlaybook) != 0 {
+			playbookLocation = REPO_LOCATION + ansiblePlaybook
+			ColorPrint(INFO, "Using path: '%s' for running ansible-playbook", playbookLocation)
+		}
+	}
+
+	ColorPrint(INFO, "Creating new VM...")
+	a.setPhase(id, 0, PHASE_CLONING)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Pick the proxmox cluster and node that can host the VM
+	a.acquireProxmox()
+	placement, err := placeVM(a.placementClients(), cfg, group, a.reservations)
+	a.releaseProxmox()
+	if errors.Is(err, ErrInfrastructureFull) {
+		a.status.InfrastructureFull(group.Name, err.Error())
+		a.events.Deployment(v1.EventTypeWarning, EVENT_INFRA_FULL, "Scale-up of group '%s' refused: %v", group.Name, err)
+	}
+	if err != nil {
+		return err
+	}
+	a.status.InfrastructureAvailable(group.Name)
+	// Hold the room of the VM until it runs or is rolled back
+	defer a.reservations.Release(placement.Reservation)
+	client := placement.Client
+	cluster := placement.Cluster.Name
+	group = &placement.Group
+	ColorPrint(INFO, "Using the following params: %s , %s , %s, %s, %s, %s", cluster, client.ApiUrl, group.Name, group.TemplateName, group.CloudInitConfig, group.NodeName)
+
+	vmid, err := a.vmids.Allocate(client, a.vmidTaken)
+	if err != nil {
+		return err
+	}
+	a.reservations.SetVmId(placement.Reservation, vmid)
+
+	// Roll back the VM on any failure from here on
+	var nodeName string
+	defer func() {
+		if err != nil {
+			a.rollback(client, vmid, nodeName, a.status.Phase(id), err.Error())
+		}
+	}()
+
+	// Lease a static address if an IPAM pool is configured
+	var lease *IpLease
+	pool, _ := cfg.ipamPool()
+	if pool != nil {
+		lease, err = AllocateLease(a.connStr, pool, vmid)
+		if err != nil {
+			return fmt.Errorf("unable to lease an IP address: %w", err)
+		}
+		ColorPrint(INFO, "Leased %s to VM %d", lease.Address, vmid)
+	}
+
+	// Render the cloud-init template of the group for this VM
+	hostname, err := a.newVmName(group, vmid)
+	if err != nil {
+		return err
+	}
+	cloudInit, err := RenderCloudInit(group.CloudInitConfig, cfg.cloudInitData(group, vmid, hostname, lease))
+	if err != nil {
+		return fmt.Errorf("cloud-init template of group '%s' is invalid: %w", group.Name, err)
+	}
+
+	var config *proxmox.ConfigQemu
+	var vmr *proxmox.VmRef
+	a.acquireProxmox()
+	err = runPhase(ctx, PHASE_CLONING, cfg.CloneTimeout, func(ctx context.Context) error {
+		var err error
+		config, vmr, err = CloneVM(ctx, client, group.TemplateName, cloudInit, group.NodeName, vmid, hostname, cfg.vmMeta(group), group.cloneOptions(group.NodeName), lease, runAnsiblePlaybook)
+		return err
+	})
+	a.releaseProxmox()
+	a.vmids.Release(vmid)
+	if err != nil {
+		return err
+	}
+	nodeName = config.Name
+	if err := InsertVmInfo(ctx, a.connStr, vmr, config, group.Name, cluster); err != nil {
+		return err
+	}
+	a.events.Deployment(v1.EventTypeNormal, EVENT_VM_CLONED, "Cloned VM '%s' with ID %d on node %s of cluster %s from template '%s'", config.Name, vmr.VmId(), vmr.Node(), cluster, group.TemplateName)
+
+	// Start the VM
+	a.setPhase(id, vmr.VmId(), PHASE_START)
+	ColorPrint(INFO, "Attempting to start the VM...")
+	err = runPhase(ctx, PHASE_START, cfg.StartTimeout, func(ctx context.Context) error {
+		err := retryWithBackoff(ctx, "Starting the VM", func() error {
+			_, err := a.startVM(ctx, client, vmr.VmId())
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return WaitForPowerOn(ctx, vmr, client)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Register the VM as HA resource so it survives a host failure
+	if len(group.HaGroup) != 0 {
+		a.setPhase(id, vmr.VmId(), PHASE_HA)
+		ColorPrint(INFO, "Adding VM %d to HA group '%s'...", vmr.VmId(), group.HaGroup)
+		a.acquireProxmox()
+		err = RegisterVmHA(ctx, client, vmr.VmId(), group.HaGroup)
+		a.releaseProxmox()
+		if err != nil {
+			return fmt.Errorf("phase %s failed: %w", PHASE_HA, err)
+		}
+		if err := UpdateVmHaGroup(a.connStr, vmr.VmId(), group.HaGroup); err != nil {
+			ColorPrint(WARN, "Unable to save the HA group of VM %d in DB: %v", vmr.VmId(), err)
+		}
+	}
+
+	// Wait for qemu agent to come up
+	a.setPhase(id, vmr.VmId(), PHASE_AGENT)
+	static := staticAddress(config)
+	var ipAddress string
+	err = runPhase(ctx, PHASE_AGENT, cfg.AgentTimeout, func(ctx context.Context) error {
+		return WaitForQemuAgent(ctx, vmr, client)
+	})
+	if err == nil {
+		// Wait for VM to attain an IP address
+		a.setPhase(id, vmr.VmId(), PHASE_IP)
+		selector, _ := cfg.ipSelector()
+		err = runPhase(ctx, PHASE_IP, cfg.IpTimeout, func(ctx context.Context) error {
+			return retryWithBackoff(ctx, "Waiting for the VM to get an IP Address", func() error {
+				// Figure out the IP Address assigned to the VM
+				interfaces, err := client.GetVmAgentNetworkInterfaces(vmr)
+				if err != nil {
+					return err
+				}
+				ipAddress, err = selector.Select(interfaces)
+				return err
+			})
+		})
+	}
+	if err != nil {
+		// Fall back to the static address from cloud-init
+		if len(static) == 0 || ctx.Err() != nil {
+			return err
+		}
+		ColorPrint(WARN, "Unable to get the IP Address from the qemu agent: %v", err)
+		ColorPrint(WARN, "Falling back to the cloud-init ipconfig0 address %s", static)
+		ipAddress, err = static, nil
+	}
+	ColorPrint(INFO, "Using %s as the IP Address of the created VM", ipAddress)
+	if err := UpdateVmAddress(a.connStr, vmr.VmId(), ipAddress); err != nil {
+		ColorPrint(WARN, "Unable to save the IP Address of VM %d in DB: %v", vmr.VmId(), err)
+	}
+
+	// Run ansible playbook(s)
+	a.setPhase(id, vmr.VmId(), PHASE_JOIN)
+	joinCtx, cancel := context.WithTimeout(ctx, time.Duration(cfg.JoinTimeout)*time.Second)
+	defer cancel()
+	sshUser := cfg.SshUser
+	if runAnsiblePlaybook {
+		inventory := inventoryPath(vmr.VmId())
+		runner := cfg.ansibleRunner()
+		var requirements string
+		if len(cfg.AnsibleRequirements) != 0 {
+			requirements = REPO_LOCATION + cfg.AnsibleRequirements
+		}
+		a.repoMu.Lock()
+		_, err := runner.Galaxy(joinCtx, requirements)
+		a.repoMu.Unlock()
+		if err != nil {
+			return fmt.Errorf("installing the ansible requirements failed: %w", err)
+		}
+
+		// Generate and parse the inventory until it is valid or the join times out
+		ColorPrint(INFO, "Generating ansible inventory...")
+		err = retryWithBackoff(joinCtx, "Generating the ansible inventory", func() error {
+			if err := generateAnsibleInventory(ipAddress, ansibleTag, config.Name, sshUser, inventory); err != nil {
+				return err
+			}
+			if err := parseAnsibleInventory(inventory); err != nil {
+				ColorPrint(WARN, "There might be an issue with the provided params")
+				ColorPrint(INFO, "Params provided: [IP ADDRESS: %s] [ANSIBLE TAG: %s] [HOSTNAME: %s] [SSH USER: %s]", ipAddress, ansibleTag, config.Name, sshUser)
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return joinError(joinCtx, cfg.JoinTimeout, err)
+		}
+
+		// Run the playbook provided
+		_, err = runner.PlaybookWithRetries(joinCtx, vmr.VmId(), ipAddress, playbookLocation, cfg.AnsibleExtraVarsFile, sshUser, cfg.JoinCommand, inventory)
+		if err != nil {
+			err = joinError(joinCtx, cfg.JoinTimeout, err)
+			ColorPrint(WARN, "Errors encountered while running the playbook: %v", err)
+			ColorPrint(WARN, "Node with IP: '%s' and ID: '%d' was unable to join the cluster!", ipAddress, vmr.VmId())
+			return fmt.Errorf("ansible playbook failed, node with IP '%s' and ID '%d' was unable to join the cluster: %w", ipAddress, vmr.VmId(), err)
+		}
+	} else {
+		err = sendCommands(joinCtx, sshUser, ipAddress, cfg.JoinCommand)
+		if err != nil {
+			err = joinError(joinCtx, cfg.JoinTimeout, err)
+			ColorPrint(WARN, "Invalid Join Command: Expired token?")
+			ColorPrint(WARN, "Node with IP: '%s' and ID: '%d' was unable to join the cluster!", ipAddress, vmr.VmId())
+			return fmt.Errorf("join command failed, node with IP '%s' and ID '%d' was unable to join the cluster: %w", ipAddress, vmr.VmId(), err)
+		}
+	}
+
+	// Attempt to add worker role the newly created node
+	a.setPhase(id, vmr.VmId(), PHASE_LABEL)
+	payload := WORKER_ROLE_PATCH
+	response, err := a.clientset.
+		CoreV1().
+		Nodes().
+		Patch(context.TODO(),
+			config.Name,
+			types.MergePatchType,
+			[]byte(payload),
+			metav1.PatchOptions{FieldManager: "kubectl-label"})
+
+	ColorPrint(INFO, response.String())
+	ColorPrint(WARN, "Errors for labeling new node: %v", err)
+
+	// Set the provider id so the node can be matched to its VM
+	_, err = a.clientset.
+		CoreV1().
+		Nodes().
+		Patch(context.TODO(),
+			config.Name,
+			types.MergePatchType,
+			[]byte(fmt.Sprintf(`{"spec":{"providerID":"%s"}}`, providerID(vmr.VmId()))),
+			metav1.PatchOptions{})
+	if err != nil {
+		ColorPrint(WARN, "Errors for setting the provider id of new node: %v", err)
+	}
+	a.events.Node(config.Name, v1.EventTypeNormal, EVENT_NODE_JOINED, "VM %d on node %s joined the cluster from group '%s'", vmr.VmId(), vmr.Node(), group.Name)
+
+	err = UpdateVmState(a.connStr, vmr.VmId(), VM_READY)
+	if err != nil {
+		ColorPrint(WARN, "Unable to mark VM %d as ready in DB: %v", vmr.VmId(), err)
+	}
+	return nil
+}
+
+/*
+ScaleDown removes a managed VM using
+its kubernetes node name. The node
+object, the VM and its DB record are
+deleted in that order.
+*/
+func (a *Autoscaler) ScaleDown(nodeName string) error {
+	err := a.scaleDown(nodeName)
+	// Nothing was removed in dry-run mode
+	if err == nil && a.config().DryRun {
+		return nil
+	}
+	if err != nil {
+		a.status.ScaleDownDone(fmt.Sprintf("Failed for node %s: %v", nodeName, err))
+	} else {
+		a.status.ScaleDownDone("Succeeded for node " + nodeName)
+	}
+	a.WriteStatus()
+	return err
+}
+
+func (a *Autoscaler) scaleDown(nodeName string) error {
+	record, err := GetVmInfoByName(a.connStr, nodeName)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return fmt.Errorf("node '%s' is not managed by the autoscaler", nodeName)
+	}
+	client, err := a.clusterClient(record.Cluster)
+	if err != nil {
+		return err
+	}
+	if a.config().DryRun {
+		ColorPrint(INFO, DRY_RUN+"Would delete node '%s' and destroy VM %d on node %s of cluster %s", nodeName, record.VmId, record.Node, record.Cluster)
+		return nil
+	}
+
+	a.events.Deployment(v1.EventTypeNormal, EVENT_SCALE_DOWN_STARTED, "Removing node '%s' backed by VM %d", nodeName, record.VmId)
+	a.events.Node(nodeName, v1.EventTypeNormal, EVENT_SCALE_DOWN_STARTED, "Removing node backed by VM %d on node %s", record.VmId, record.Node)
+	ColorPrint(INFO, "Deleting node '%s' from the cluster...", nodeName)
+	err = a.clientset.CoreV1().Nodes().Delete(context.TODO(), nodeName, metav1.DeleteOptions{})
+	if err != nil {
+		ColorPrint(WARN, "Unable to delete node '%s': %v", nodeName, err)
+	}
+	if len(record.HaGroup) != 0 {
+		ColorPrint(INFO, "Removing VM %d from HA group '%s'...", record.VmId, record.HaGroup)
+		a.acquireProxmox()
+		err = RemoveVmHA(context.TODO(), client, record.VmId)
+		a.releaseProxmox()
+		if err != nil {
+			return fmt.Errorf("unable to remove VM %d from HA: %w", record.VmId, err)
+		}
+		if err := UpdateVmHaGroup(a.connStr, record.VmId, ""); err != nil {
+			ColorPrint(WARN, "Unable to clear the HA group of VM %d in DB: %v", record.VmId, err)
+		}
+	}
+	ColorPrint(INFO, "Destroying VM with ID: '%d'", record.VmId)
+	if err := a.destroyWithRetry(client, record.VmId, true); err != nil {
+		return err
+	}
+	return DeleteVmInfo(a.connStr, record.VmId)
+}
+
+/*
+Destroys a VM, retrying until
+destroyTimeout expires. The graceful
+shutdown counts against that budget.
+*/
+func (a *Autoscaler) destroyWithRetry(client *proxmox.Client, vmid int, graceful bool) error {
+	return runPhase(context.Background(), "Destroying", a.config().DestroyTimeout, func(ctx context.Context) error {
+		return retryWithBackoff(ctx, fmt.Sprintf("Destroying VM %d", vmid), func() error {
+			_, err := a.destroyVM(ctx, client, vmid, graceful)
+			return err
+		})
+	})
+}
+
+// Marks a join failure caused by an expired joinTimeout
+func joinError(ctx context.Context, timeout int, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("phase %s did not finish within %ds: %w", PHASE_JOIN, timeout, err)
+	}
+	return err
+}
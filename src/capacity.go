@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+)
+
+// Returned when no candidate node can host a new VM
+var ErrInfrastructureFull = errors.New("infrastructure full")
+
+/*
+NodeCapacity is the memory and CPU of a
+proxmox node together with what the VMs
+on it were given. MemReserved is the
+memory of VMs being provisioned that
+are not running yet. Memory is in
+bytes.
+*/
+type NodeCapacity struct {
+	Node         string
+	MemTotal     float64
+	MemUsed      float64
+	MemReserved  float64
+	MemAllocated float64
+	Cpus         float64
+	CpuAllocated float64
+}
+
+// Resources a new VM asks for
+type VmSize struct {
+	Memory float64
+	Cores  float64
+}
+
+/*
+Reservation is the room a VM was given
+on a node when it was placed. VmId is
+set once the vmid is allocated, so the
+reservation is not counted twice after
+the clone shows up in the VM list.
+*/
+type Reservation struct {
+	Client *proxmox.Client
+	Node   string
+	Size   VmSize
+	VmId   int
+}
+
+/*
+Reservations tracks the VMs that are
+being provisioned. Placements are
+serialized so that parallel scale-ups
+do not hand out the same room twice.
+*/
+type Reservations struct {
+	placing sync.Mutex
+	mu      sync.Mutex
+	items   map[*Reservation]bool
+}
+
+func NewReservations() *Reservations {
+	return &Reservations{items: map[*Reservation]bool{}}
+}
+
+func (r *Reservations) Add(res *Reservation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.items[res] = true
+}
+
+// Records the vmid a reservation was cloned with
+func (r *Reservations) SetVmId(res *Reservation, vmid int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res.VmId = vmid
+}
+
+// Releases a reservation once its VM is running or was rolled back
+func (r *Reservations) Release(res *Reservation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.items, res)
+}
+
+// Returns copies of the reservations on a node
+func (r *Reservations) on(client *proxmox.Client, node string) []Reservation {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var list []Reservation
+	for res := range r.items {
+		if res.Client == client && res.Node == node {
+			list = append(list, *res)
+		}
+	}
+	return list
+}
+
+/*
+GetNodeCapacity reads the status of a
+node and adds up the memory and cores
+of all VMs on it from the cluster VM
+list. Stopped VMs count as allocated
+since they can be started at any time.
+Reserved VMs that are not in the list
+yet are added, and the memory of the
+ones that are not running yet is held
+back from the free memory.
+*/
+func GetNodeCapacity(client *proxmox.Client, node string, vms []interface{}, reserved []Reservation) (*NodeCapacity, error) {
+	var data map[string]interface{}
+	if err := client.GetJsonRetryable(fmt.Sprintf("/nodes/%s/status", node), &data, 3); err != nil {
+		return nil, err
+	}
+	status, _ := data["data"].(map[string]interface{})
+	memory, _ := status["memory"].(map[string]interface{})
+	cpuinfo, _ := status["cpuinfo"].(map[string]interface{})
+	capacity := &NodeCapacity{Node: node}
+	capacity.MemTotal, _ = memory["total"].(float64)
+	capacity.MemUsed, _ = memory["used"].(float64)
+	capacity.Cpus, _ = cpuinfo["cpus"].(float64)
+
+	// vmid of every listed VM and whether it runs
+	running := map[int]bool{}
+	for _, item := range vms {
+		vm, _ := item.(map[string]interface{})
+		if vm["node"] != node {
+			continue
+		}
+		if template, _ := vm["template"].(float64); template == 1 {
+			continue
+		}
+		vmid, _ := vm["vmid"].(float64)
+		running[int(vmid)] = vm["status"] == "running"
+		maxmem, _ := vm["maxmem"].(float64)
+		maxcpu, _ := vm["maxcpu"].(float64)
+		capacity.MemAllocated += maxmem
+		capacity.CpuAllocated += maxcpu
+	}
+	for _, res := range reserved {
+		started, listed := running[res.VmId]
+		if res.VmId == 0 || !listed {
+			capacity.MemAllocated += res.Size.Memory
+			capacity.CpuAllocated += res.Size.Cores
+		}
+		if res.VmId == 0 || !started {
+			capacity.MemReserved += res.Size.Memory
+		}
+	}
+	return capacity, nil
+}
+
+/*
+Fits returns why the VM does not fit on
+the node, or "" if it does. Free memory
+must cover the VM and the allocated
+memory and cores must stay within the
+overcommit ratios.
+*/
+func (n *NodeCapacity) Fits(size VmSize, memOvercommit float64, cpuOvercommit float64) string {
+	if free := n.Free(); free < size.Memory {
+		return fmt.Sprintf("node %s has %s free memory but the VM needs %s", n.Node, formatGB(free), formatGB(size.Memory))
+	}
+	if limit := n.MemTotal * memOvercommit; n.MemAllocated+size.Memory > limit {
+		return fmt.Sprintf("node %s has %s of memory allocated, adding %s exceeds the limit of %s", n.Node, formatGB(n.MemAllocated), formatGB(size.Memory), formatGB(limit))
+	}
+	if limit := n.Cpus * cpuOvercommit; n.CpuAllocated+size.Cores > limit {
+		return fmt.Sprintf("node %s has %g cores allocated, adding %g exceeds the limit of %g", n.Node, n.CpuAllocated, size.Cores, limit)
+	}
+	return ""
+}
+
+// Memory that is neither used nor reserved
+func (n *NodeCapacity) Free() float64 {
+	return n.MemTotal - n.MemUsed - n.MemReserved
+}
+
+func formatGB(bytes float64) string {
+	return strconv.FormatFloat(bytes/(1<<30), 'f', 1, 64) + "G"
+}
+
+/*
+vmSize reads the memory and cores of a
+new VM from its rendered cloud-init
+config and falls back to the template
+for values it does not set.
+*/
+func vmSize(client *proxmox.Client, config *proxmox.ConfigQemu, sourceVmr *proxmox.VmRef) (VmSize, error) {
+	size := VmSize{Memory: float64(config.Memory) * (1 << 20), Cores: float64(config.QemuCores * max(config.QemuSockets, 1))}
+	if size.Memory != 0 && size.Cores != 0 {
+		return size, nil
+	}
+	template, err := client.GetVmConfig(sourceVmr)
+	if err != nil {
+		return size, err
+	}
+	if size.Memory == 0 {
+		memory, _ := strconv.ParseFloat(fmt.Sprint(template["memory"]), 64)
+		size.Memory = memory * (1 << 20)
+	}
+	if size.Cores == 0 {
+		cores, _ := strconv.ParseFloat(fmt.Sprint(template["cores"]), 64)
+		sockets, _ := strconv.ParseFloat(fmt.Sprint(template["sockets"]), 64)
+		size.Cores = max(cores, 1) * max(sockets, 1)
+	}
+	return size, nil
+}
+
+/*
+PlaceVM picks the first node of the
+group that can host the VM, starting
+with its target node and then trying
+its fallback nodes. Memory, CPU and
+storage room are checked against what
+the node has left after the reserved
+VMs. The returned reservation holds the
+chosen node and the size of the VM,
+together with the free memory of that
+node. The returned error wraps
+ErrInfrastructureFull and lists why
+each node was refused.
+*/
+func PlaceVM(client *proxmox.Client, cfg *Config, group *NodeGroup, cloudInit []byte, reserved *Reservations) (*Reservation, float64, error) {
+	if !cfg.CapacityCheck {
+		return &Reservation{Client: client, Node: group.NodeName}, 0, nil
+	}
+	sourceVmrs, err := client.GetVmRefsByName(group.TemplateName)
+	if err != nil {
+		return nil, 0, err
+	}
+	if sourceVmrs == nil {
+		return nil, 0, errors.New("Can't find template " + group.TemplateName)
+	}
+	config, err := parseQemuConfig(cloudInit)
+	if err != nil {
+		return nil, 0, err
+	}
+	list, err := client.GetVmList()
+	if err != nil {
+		return nil, 0, err
+	}
+	vms, _ := list["data"].([]interface{})
+
+	var refused []string
+	for _, node := range group.candidateNodes() {
+		// Prefer a copy of the template on the node
+		sourceVmr := sourceVmrs[0]
+		for _, candVmr := range sourceVmrs {
+			if candVmr.Node() == node {
+				sourceVmr = candVmr
+			}
+		}
+		size, err := vmSize(client, config, sourceVmr)
+		if err != nil {
+			return nil, 0, err
+		}
+		capacity, err := GetNodeCapacity(client, node, vms, reserved.on(client, node))
+		if err != nil {
+			refused = append(refused, fmt.Sprintf("node %s: %v", node, err))
+			continue
+		}
+		if reason := capacity.Fits(size, cfg.MemoryOvercommit, cfg.CpuOvercommit); len(reason) != 0 {
+			refused = append(refused, reason)
+			continue
+		}
+		if err := checkStorageRoom(client, sourceVmr, node, group.cloneOptions(node).forConfig(config)); err != nil {
+			refused = append(refused, err.Error())
+			continue
+		}
+		if node != group.NodeName {
+			ColorPrint(WARN, "Node %s of group '%s' is full, using node %s instead", group.NodeName, group.Name, node)
+		}
+		return &Reservation{Client: client, Node: node, Size: size}, capacity.Free(), nil
+	}
+	return nil, 0, fmt.Errorf("%w: %s", ErrInfrastructureFull, strings.Join(refused, "; "))
+}
+
+// Returns the target node followed by the fallback nodes
+func (g *NodeGroup) candidateNodes() []string {
+	nodes := []string{g.NodeName}
+	for _, node := range g.FallbackNodes {
+		if node != g.NodeName {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+)
+
+func TestGetNodeCapacity(t *testing.T) {
+	backend := newFakeProxmox(t)
+	backend.addVM(fakeVM{VmId: 9000, Name: "template", Node: "pve", Template: true, MaxMem: 8 << 30, MaxCpu: 8})
+	backend.addVM(fakeVM{VmId: 120, Name: "k8s-default-120", Node: "pve", Status: "running", MaxMem: 4 << 30, MaxCpu: 2})
+	backend.addVM(fakeVM{VmId: 121, Name: "k8s-default-121", Node: "pve", Status: "stopped", MaxMem: 2 << 30, MaxCpu: 1})
+	backend.addVM(fakeVM{VmId: 122, Name: "k8s-default-122", Node: "pve", Status: "stopped", MaxMem: 2 << 30, MaxCpu: 2})
+	backend.addVM(fakeVM{VmId: 130, Name: "other", Node: "pve2", Status: "running", MaxMem: 16 << 30, MaxCpu: 8})
+	client := backend.client(t)
+	list, err := client.GetVmList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vms, _ := list["data"].([]interface{})
+
+	reserved := []Reservation{
+		// Placed, vmid not allocated yet
+		{Client: client, Node: "pve", Size: VmSize{Memory: 1 << 30, Cores: 1}},
+		// Just cloned and not started yet
+		{Client: client, Node: "pve", Size: VmSize{Memory: 2 << 30, Cores: 2}, VmId: 122},
+		// Cloning, not in the VM list yet
+		{Client: client, Node: "pve", Size: VmSize{Memory: 1 << 30, Cores: 1}, VmId: 123},
+		// Already running
+		{Client: client, Node: "pve", Size: VmSize{Memory: 4 << 30, Cores: 2}, VmId: 120},
+	}
+	capacity, err := GetNodeCapacity(client, "pve", vms, reserved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if capacity.MemAllocated != 10<<30 || capacity.CpuAllocated != 7 {
+		t.Fatalf("allocated %s and %g cores, want 10.0G and 7", formatGB(capacity.MemAllocated), capacity.CpuAllocated)
+	}
+	if capacity.MemReserved != 4<<30 || capacity.Free() != 52<<30 {
+		t.Fatalf("reserved %s and free %s, want 4.0G and 52.0G", formatGB(capacity.MemReserved), formatGB(capacity.Free()))
+	}
+}
+
+/*
+Each placement reserves the room of its
+VM, so scale-ups stop once the reserved
+memory no longer fits, before any of
+the VMs exist.
+*/
+func TestPlaceVMReservations(t *testing.T) {
+	backend := newFakeProxmox(t)
+	backend.nodes["pve"] = fakeNode{MemTotal: 8 << 30, MemUsed: 3 << 30, Cpus: 16}
+	backend.addVM(fakeVM{VmId: 9000, Name: "template", Node: "pve", Template: true})
+	client := backend.client(t)
+	cfg := testConfig()
+	cfg.CapacityCheck = true
+	clients := map[string]*proxmox.Client{DEFAULT_CLUSTER: client}
+	group := cfg.NodeGroups[0]
+	reserved := NewReservations()
+
+	var placements []*Placement
+	for i := 0; i < 2; i++ {
+		placement, err := placeVM(clients, cfg, &group, reserved)
+		if err != nil {
+			t.Fatalf("placement %d: %v", i, err)
+		}
+		if placement.Reservation.Size.Memory != 2<<30 {
+			t.Fatalf("reserved %s, want 2.0G", formatGB(placement.Reservation.Size.Memory))
+		}
+		placements = append(placements, placement)
+	}
+	if _, err := placeVM(clients, cfg, &group, reserved); !errors.Is(err, ErrInfrastructureFull) {
+		t.Fatalf("third placement = %v, want ErrInfrastructureFull", err)
+	}
+	// A dry run does not see or take reservations
+	if _, err := placeVM(clients, cfg, &group, nil); err != nil {
+		t.Fatalf("dry-run placement = %v", err)
+	}
+
+	reserved.Release(placements[0].Reservation)
+	if _, err := placeVM(clients, cfg, &group, reserved); err != nil {
+		t.Fatalf("placement after a release = %v", err)
+	}
+}
+
+func TestInfrastructureFullMetric(t *testing.T) {
+	status := NewAutoscalerStatus()
+	before := infraFullTotal.Value("gpu")
+	status.InfrastructureFull("gpu", "no room")
+	status.InfrastructureFull("gpu", "no room")
+	if hits := infraFullTotal.Value("gpu") - before; hits != 2 {
+		t.Fatalf("counter went up by %g, want 2", hits)
+	}
+
+	recorder := httptest.NewRecorder()
+	metricsHandler(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, want := range []string{
+		"# TYPE pve_autoscaler_infrastructure_full_total counter",
+		`pve_autoscaler_infrastructure_full_total{group="gpu"} `,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("metrics do not contain %q:\n%s", want, body)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ServeMetrics(ctx, ""); err != nil {
+		t.Fatalf("ServeMetrics() with the endpoint turned off = %v", err)
+	}
+}
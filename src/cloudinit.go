@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"text/template"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+)
+
+/*
+CloudInitData holds the variables
+available to the cloud-init template
+of a node group, e.g. {{.Hostname}}
+or {{json .SshKeys}}.
+*/
+type CloudInitData struct {
+	VmId        int
+	Hostname    string
+	Group       string
+	Node        string
+	IP          string
+	Ipconfig    string
+	Gateway     string
+	Nameserver  string
+	SshKeys     string
+	JoinCommand string
+}
+
+// Functions usable in cloud-init templates
+var cloudInitFuncs = template.FuncMap{
+	// Quotes a value as a JSON string
+	"json": func(value interface{}) (string, error) {
+		out, err := json.Marshal(value)
+		return string(out), err
+	},
+}
+
+/*
+RenderCloudInit renders the cloud-init
+template for a single VM and checks
+that the result is a valid qemu config
+before anything is cloned.
+*/
+func RenderCloudInit(raw []byte, data CloudInitData) ([]byte, error) {
+	tmpl, err := template.New("cloud-init").Option("missingkey=error").Funcs(cloudInitFuncs).Parse(string(raw))
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return nil, err
+	}
+	if _, err := parseQemuConfig(out.Bytes()); err != nil {
+		return nil, fmt.Errorf("rendered config is not valid: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+/*
+parseQemuConfig decodes a rendered
+cloud-init config like
+proxmox.NewConfigQemuFromJson, which
+exits the process on invalid JSON.
+*/
+func parseQemuConfig(raw []byte) (*proxmox.ConfigQemu, error) {
+	config := &proxmox.ConfigQemu{QemuVlanTag: -1, QemuKVM: true}
+	if err := json.NewDecoder(bytes.NewReader(raw)).Decode(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Renders the template with sample values to validate it
+func ValidateCloudInit(raw []byte) error {
+	_, err := RenderCloudInit(raw, CloudInitData{
+		VmId:        100,
+		Hostname:    "validate-100",
+		Group:       DEFAULT_GROUP,
+		Node:        "pve",
+		IP:          "192.0.2.10",
+		Ipconfig:    "ip=192.0.2.10/24,gw=192.0.2.1",
+		Gateway:     "192.0.2.1",
+		Nameserver:  "192.0.2.1",
+		SshKeys:     "ssh-ed25519 AAAA validate",
+		JoinCommand: "kubeadm join",
+	})
+	return err
+}
+
+// Builds the template variables of a new VM
+func (c *Config) cloudInitData(group *NodeGroup, vmid int, hostname string, lease *IpLease) CloudInitData {
+	data := CloudInitData{
+		VmId:        vmid,
+		Hostname:    hostname,
+		Group:       group.Name,
+		Node:        group.NodeName,
+		SshKeys:     c.SshPublicKeys,
+		JoinCommand: c.JoinCommand,
+	}
+	if lease != nil {
+		data.IP = lease.Address
+		data.Ipconfig = lease.Ipconfig()
+		data.Gateway = lease.Gateway
+		data.Nameserver = lease.Nameserver
+	}
+	return data
+}
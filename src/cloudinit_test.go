@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderCloudInit(t *testing.T) {
+	data := CloudInitData{VmId: 120, Hostname: "k8s-default-120", SshKeys: "ssh-ed25519 AAAA a@b"}
+	tests := []struct {
+		name    string
+		raw     string
+		want    string
+		wantErr string
+	}{
+		{"rendered", TEST_CLOUD_INIT, `"name": "k8s-default-120"`, ""},
+		{"json function", `{"sshkeys": {{json .SshKeys}}}`, `"sshkeys": "ssh-ed25519 AAAA a@b"`, ""},
+		{"unknown field", `{"name": "{{.Cluster}}"}`, "", "can't evaluate field Cluster"},
+		{"invalid json", `{"name": "{{.Hostname}}",}`, "", "rendered config is not valid"},
+		{"wrong type", `{"memory": "2G"}`, "", "rendered config is not valid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := RenderCloudInit([]byte(tt.raw), data)
+			if len(tt.wantErr) != 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("RenderCloudInit() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !strings.Contains(string(out), tt.want) {
+				t.Fatalf("RenderCloudInit() = %s, %v", out, err)
+			}
+		})
+	}
+}
+
+func TestParseQemuConfigDefaults(t *testing.T) {
+	config, err := parseQemuConfig([]byte(`{"cores": 4}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.QemuCores != 4 || config.QemuVlanTag != -1 || !config.QemuKVM {
+		t.Fatalf("parseQemuConfig() = %+v", config)
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/Naman1997/pve-cluster-autoscaler/externalgrpc/protos"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+const PROVIDER_ID_PREFIX = "proxmox://"
+
+// Returns the kubernetes provider id of a VM
+func providerID(vmid int) string {
+	return PROVIDER_ID_PREFIX + strconv.Itoa(vmid)
+}
+
+/*
+CloudProviderServer serves the upstream
+cluster-autoscaler externalgrpc
+CloudProvider protocol. Node groups map
+to the configured NodeGroups and size
+changes go through ScaleUp/ScaleDown.
+*/
+type CloudProviderServer struct {
+	protos.UnimplementedCloudProviderServer
+	a       *Autoscaler
+	watcher *ConfigWatcher
+	ctx     context.Context
+	workers sync.WaitGroup
+
+	// pending counts the requested VMs per group
+	// that no worker has picked up yet, queue
+	// holds the group of each in request order
+	mu      sync.Mutex
+	pending map[string]int
+	queue   []string
+	wake    chan struct{}
+
+	// Held for reading while VMs are changed
+	// and for writing while config is swapped
+	busy sync.RWMutex
+}
+
+func NewCloudProviderServer(ctx context.Context, a *Autoscaler, watcher *ConfigWatcher) *CloudProviderServer {
+	workers := a.config().MaxConcurrentProvisions
+	s := &CloudProviderServer{
+		a:       a,
+		watcher: watcher,
+		ctx:     ctx,
+		pending: map[string]int{},
+		wake:    make(chan struct{}, workers),
+	}
+	for i := 0; i < workers; i++ {
+		s.workers.Add(1)
+		go s.provision()
+	}
+	return s
+}
+
+/*
+next takes the oldest requested VM off
+the queue and registers it as in flight
+in the same step, so targetSize never
+misses it. Requests that were cancelled
+by NodeGroupDecreaseTargetSize are
+skipped.
+*/
+func (s *CloudProviderServer) next() (string, int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.queue) > 0 {
+		groupName := s.queue[0]
+		s.queue = s.queue[1:]
+		if s.pending[groupName] == 0 {
+			continue
+		}
+		s.pending[groupName]--
+		return groupName, s.a.status.StartProvisioning(groupName), true
+	}
+	return "", 0, false
+}
+
+/*
+provision works through the requested
+scale-ups one VM at a time. One worker
+runs per maxConcurrentProvisions.
+Workers stop once ctx is done.
+*/
+func (s *CloudProviderServer) provision() {
+	defer s.workers.Done()
+	for s.ctx.Err() == nil {
+		groupName, id, ok := s.next()
+		if !ok {
+			select {
+			case <-s.ctx.Done():
+			case <-s.wake:
+			}
+			continue
+		}
+
+		s.busy.RLock()
+		cfg := s.a.config()
+		group := cfg.Group(groupName)
+		if group == nil {
+			ColorPrint(WARN, "Node group '%s' was removed from the config. Skipping scale-up.", groupName)
+			s.a.status.FinishProvisioning(id)
+		} else if cfg.DryRun {
+			PlanScaleUp(s.a.placementClients(), cfg, group, 1, 0, 0)
+			s.a.status.FinishProvisioning(id)
+		} else {
+			vmCtx, cancel := s.a.vmContext(s.ctx)
+			if err := s.a.scaleUpTracked(vmCtx, group, id); err != nil {
+				ColorPrint(WARN, "Scale-up requested over gRPC failed: %v", err)
+			}
+			cancel()
+		}
+		s.busy.RUnlock()
+	}
+}
+
+// Returns the config currently in effect
+func (s *CloudProviderServer) cfg() *Config {
+	s.busy.RLock()
+	defer s.busy.RUnlock()
+	return s.a.config()
+}
+
+// Converts a configured node group to its protobuf form
+func groupProto(group *NodeGroup) *protos.NodeGroup {
+	return &protos.NodeGroup{
+		Id:      group.Name,
+		MinSize: int32(group.MinSize),
+		MaxSize: int32(group.MaxSize),
+		Debug:   fmt.Sprintf("%s: template '%s' on node '%s'", group.Name, group.TemplateName, group.NodeName),
+	}
+}
+
+// Returns the configured group or a NotFound error
+func (s *CloudProviderServer) group(id string) (*NodeGroup, error) {
+	group := s.cfg().Group(id)
+	if group == nil {
+		return nil, status.Errorf(codes.NotFound, "node group '%s' is not configured", id)
+	}
+	return group, nil
+}
+
+// Returns the managed VMs of a group
+func (s *CloudProviderServer) records(group string) ([]VmRecord, error) {
+	records, err := s.a.listVms()
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "unable to list managed VMs: %v", err)
+	}
+	var inGroup []VmRecord
+	for _, record := range records {
+		if record.Group == group {
+			inGroup = append(inGroup, record)
+		}
+	}
+	return inGroup, nil
+}
+
+/*
+targetSize is the number of managed VMs
+plus the scale-ups that were requested
+but have not been saved to the DB yet.
+*/
+func (s *CloudProviderServer) targetSize(group string) (int, error) {
+	records, err := s.records(group)
+	if err != nil {
+		return 0, err
+	}
+	recorded := map[int]bool{}
+	for _, record := range records {
+		recorded[record.VmId] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(records) + s.pending[group] + s.a.status.Unrecorded(group, recorded), nil
+}
+
+// Finds the managed VM backing a kubernetes node
+func (s *CloudProviderServer) recordForNode(node *protos.ExternalGrpcNode) (*VmRecord, error) {
+	records, err := s.a.listVms()
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "unable to list managed VMs: %v", err)
+	}
+	for i := range records {
+		if node.GetProviderID() == providerID(records[i].VmId) || node.GetName() == records[i].Name {
+			return &records[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *CloudProviderServer) NodeGroups(ctx context.Context, req *protos.NodeGroupsRequest) (*protos.NodeGroupsResponse, error) {
+	cfg := s.cfg()
+	var groups []*protos.NodeGroup
+	for i := range cfg.NodeGroups {
+		groups = append(groups, groupProto(&cfg.NodeGroups[i]))
+	}
+	return &protos.NodeGroupsResponse{NodeGroups: groups}, nil
+}
+
+func (s *CloudProviderServer) NodeGroupForNode(ctx context.Context, req *protos.NodeGroupForNodeRequest) (*protos.NodeGroupForNodeResponse, error) {
+	record, err := s.recordForNode(req.GetNode())
+	if err != nil {
+		return nil, err
+	}
+	// An empty id tells cluster-autoscaler to ignore the node
+	if record == nil || s.cfg().Group(record.Group) == nil {
+		return &protos.NodeGroupForNodeResponse{NodeGroup: &protos.NodeGroup{}}, nil
+	}
+	return &protos.NodeGroupForNodeResponse{NodeGroup: groupProto(s.cfg().Group(record.Group))}, nil
+}
+
+func (s *CloudProviderServer) GPULabel(ctx context.Context, req *protos.GPULabelRequest) (*protos.GPULabelResponse, error) {
+	return &protos.GPULabelResponse{}, nil
+}
+
+func (s *CloudProviderServer) GetAvailableGPUTypes(ctx context.Context, req *protos.GetAvailableGPUTypesRequest) (*protos.GetAvailableGPUTypesResponse, error) {
+	return &protos.GetAvailableGPUTypesResponse{}, nil
+}
+
+func (s *CloudProviderServer) Cleanup(ctx context.Context, req *protos.CleanupRequest) (*protos.CleanupResponse, error) {
+	return &protos.CleanupResponse{}, nil
+}
+
+/*
+Refresh is called before every
+cluster-autoscaler loop. Pending config
+changes are applied here unless a VM is
+being changed at the moment.
+*/
+func (s *CloudProviderServer) Refresh(ctx context.Context, req *protos.RefreshRequest) (*protos.RefreshResponse, error) {
+	if s.busy.TryLock() {
+		s.a.ApplyConfig(s.watcher.Apply(s.a.config()))
+		s.busy.Unlock()
+	}
+	s.a.WriteStatus()
+	return &protos.RefreshResponse{}, nil
+}
+
+func (s *CloudProviderServer) NodeGroupTargetSize(ctx context.Context, req *protos.NodeGroupTargetSizeRequest) (*protos.NodeGroupTargetSizeResponse, error) {
+	if _, err := s.group(req.GetId()); err != nil {
+		return nil, err
+	}
+	size, err := s.targetSize(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return &protos.NodeGroupTargetSizeResponse{TargetSize: int32(size)}, nil
+}
+
+func (s *CloudProviderServer) NodeGroupIncreaseSize(ctx context.Context, req *protos.NodeGroupIncreaseSizeRequest) (*protos.NodeGroupIncreaseSizeResponse, error) {
+	group, err := s.group(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if req.GetDelta() <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "size increase must be positive")
+	}
+	size, err := s.targetSize(group.Name)
+	if err != nil {
+		return nil, err
+	}
+	if size+int(req.GetDelta()) > group.MaxSize {
+		return nil, status.Errorf(codes.InvalidArgument, "size increase too large - desired: %d max: %d", size+int(req.GetDelta()), group.MaxSize)
+	}
+
+	ColorPrint(INFO, "Increasing size of group '%s' by %d over gRPC", group.Name, req.GetDelta())
+	s.mu.Lock()
+	s.pending[group.Name] += int(req.GetDelta())
+	for i := 0; i < int(req.GetDelta()); i++ {
+		s.queue = append(s.queue, group.Name)
+	}
+	s.mu.Unlock()
+	// Wake idle workers without waiting for busy ones
+	for i := 0; i < int(req.GetDelta()); i++ {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+	return &protos.NodeGroupIncreaseSizeResponse{}, nil
+}
+
+func (s *CloudProviderServer) NodeGroupDeleteNodes(ctx context.Context, req *protos.NodeGroupDeleteNodesRequest) (*protos.NodeGroupDeleteNodesResponse, error) {
+	group, err := s.group(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	size, err := s.targetSize(group.Name)
+	if err != nil {
+		return nil, err
+	}
+	if size-len(req.GetNodes()) < group.MinSize {
+		return nil, status.Errorf(codes.InvalidArgument, "size decrease too large - desired: %d min: %d", size-len(req.GetNodes()), group.MinSize)
+	}
+
+	s.busy.RLock()
+	defer s.busy.RUnlock()
+	for _, node := range req.GetNodes() {
+		record, err := s.recordForNode(node)
+		if err != nil {
+			return nil, err
+		}
+		if record == nil || record.Group != group.Name {
+			return nil, status.Errorf(codes.InvalidArgument, "node '%s' does not belong to group '%s'", node.GetName(), group.Name)
+		}
+		ColorPrint(INFO, "Deleting node '%s' from group '%s' over gRPC", record.Name, group.Name)
+		if err := s.a.ScaleDown(record.Name); err != nil {
+			return nil, status.Errorf(codes.Internal, "unable to delete node '%s': %v", record.Name, err)
+		}
+	}
+	return &protos.NodeGroupDeleteNodesResponse{}, nil
+}
+
+func (s *CloudProviderServer) NodeGroupDecreaseTargetSize(ctx context.Context, req *protos.NodeGroupDecreaseTargetSizeRequest) (*protos.NodeGroupDecreaseTargetSizeResponse, error) {
+	group, err := s.group(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if req.GetDelta() >= 0 {
+		return nil, status.Error(codes.InvalidArgument, "size decrease must be negative")
+	}
+	// Only scale-ups that have not started yet can be cancelled
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending[group.Name] < int(-req.GetDelta()) {
+		return nil, status.Errorf(codes.InvalidArgument, "attempt to delete existing nodes - pending: %d delta: %d", s.pending[group.Name], req.GetDelta())
+	}
+	s.pending[group.Name] += int(req.GetDelta())
+	return &protos.NodeGroupDecreaseTargetSizeResponse{}, nil
+}
+
+func (s *CloudProviderServer) NodeGroupNodes(ctx context.Context, req *protos.NodeGroupNodesRequest) (*protos.NodeGroupNodesResponse, error) {
+	group, err := s.group(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	records, err := s.records(group.Name)
+	if err != nil {
+		return nil, err
+	}
+	var instances []*protos.Instance
+	for _, record := range records {
+		instanceStatus := &protos.InstanceStatus{InstanceState: protos.InstanceStatus_instanceRunning}
+		switch record.State {
+		case VM_PROVISIONING:
+			instanceStatus.InstanceState = protos.InstanceStatus_instanceCreating
+		case VM_FAILED:
+			instanceStatus.InstanceState = protos.InstanceStatus_instanceCreating
+			instanceStatus.ErrorInfo = &protos.InstanceErrorInfo{
+				ErrorCode:    "ProvisioningFailed",
+				ErrorMessage: fmt.Sprintf("VM %d failed to provision", record.VmId),
+			}
+		}
+		instances = append(instances, &protos.Instance{Id: providerID(record.VmId), Status: instanceStatus})
+	}
+	return &protos.NodeGroupNodesResponse{Instances: instances}, nil
+}
+
+/*
+ServeCloudProvider listens on the address
+and serves the externalgrpc protocol
+until the listener fails or ctx is
+done. TLS is used
+when a certificate and key are given
+and client certificates are verified
+when a CA is given as well.
+*/
+func ServeCloudProvider(ctx context.Context, a *Autoscaler, watcher *ConfigWatcher, address string, certFile string, keyFile string, caFile string) error {
+	var opts []grpc.ServerOption
+	if len(certFile) != 0 && len(keyFile) != 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+		if len(caFile) != 0 {
+			ca, err := os.ReadFile(caFile)
+			if err != nil {
+				return err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return errors.New("no certificates found in " + caFile)
+			}
+			tlsConfig.ClientCAs = pool
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	} else if len(certFile) != 0 || len(keyFile) != 0 {
+		return errors.New("both --cert and --key are needed for TLS")
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	server := grpc.NewServer(opts...)
+	provider := NewCloudProviderServer(ctx, a, watcher)
+	protos.RegisterCloudProviderServer(server, provider)
+
+	// Stop serving on shutdown and let in-flight VMs finish
+	go func() {
+		<-ctx.Done()
+		ColorPrint(INFO, "Shutdown requested. Stopping the gRPC server...")
+		server.GracefulStop()
+	}()
+	ColorPrint(INFO, "Serving the externalgrpc cloud provider on %s", address)
+	err = server.Serve(listener)
+	provider.workers.Wait()
+	return err
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Naman1997/pve-cluster-autoscaler/externalgrpc/protos"
+	"github.com/Telmate/proxmox-api-go/proxmox"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const TEST_CLOUD_INIT = `{"name": "{{.Hostname}}", "memory": 2048, "cores": 2, "sockets": 1}`
+
+// Builds a dry-run config with a default and a gpu group on node pve
+func testConfig() *Config {
+	cfg := &Config{
+		Clusters:                []ProxmoxCluster{{Name: DEFAULT_CLUSTER}},
+		ClusterSelection:        CLUSTER_SELECTION_PRIORITY,
+		DryRun:                  true,
+		MemoryOvercommit:        1.5,
+		CpuOvercommit:           4,
+		MaxConcurrentProvisions: 3,
+		MaxProxmoxRequests:      2,
+		NodeName:                "pve",
+		TemplateName:            "template",
+		NamePrefix:              "k8s",
+		NamePattern:             DEFAULT_NAME_PATTERN,
+		InstanceId:              AUTOSCALER_NAME,
+		CloudInitConfig:         []byte(TEST_CLOUD_INIT),
+	}
+	fullClone := true
+	for _, group := range []NodeGroup{{Name: DEFAULT_GROUP, MinSize: 1, MaxSize: 200}, {Name: "gpu", MaxSize: 2}} {
+		group.TemplateName = cfg.TemplateName
+		group.NodeName = cfg.NodeName
+		group.FullClone = &fullClone
+		group.CloudInitConfig = cfg.CloudInitConfig
+		cfg.NodeGroups = append(cfg.NodeGroups, group)
+	}
+	return cfg
+}
+
+// Builds an autoscaler on the fake proxmox backend and a fake kubernetes API
+func newTestAutoscaler(cfg *Config, client *proxmox.Client, records *[]VmRecord) *Autoscaler {
+	clientset := fake.NewSimpleClientset()
+	return &Autoscaler{
+		cfg:          cfg,
+		clients:      map[string]*proxmox.Client{DEFAULT_CLUSTER: client},
+		clientset:    clientset,
+		events:       NewEventRecorder(clientset),
+		status:       NewAutoscalerStatus(),
+		listVms:      func() ([]VmRecord, error) { return *records, nil },
+		vmids:        NewVmidAllocator(),
+		reservations: NewReservations(),
+		proxmoxSlots: make(chan struct{}, cfg.MaxProxmoxRequests),
+	}
+}
+
+// Serves the cloud provider on a local port and returns a client for it
+func serveTestProvider(t *testing.T, a *Autoscaler) (protos.CloudProviderClient, *CloudProviderServer) {
+	ctx, cancel := context.WithCancel(context.Background())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	provider := NewCloudProviderServer(ctx, a, &ConfigWatcher{})
+	protos.RegisterCloudProviderServer(server, provider)
+	go server.Serve(listener)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		cancel()
+		server.Stop()
+		provider.workers.Wait()
+	})
+	return protos.NewCloudProviderClient(conn), provider
+}
+
+func targetSize(t *testing.T, client protos.CloudProviderClient, group string) int {
+	t.Helper()
+	resp, err := client.NodeGroupTargetSize(context.Background(), &protos.NodeGroupTargetSizeRequest{Id: group})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int(resp.GetTargetSize())
+}
+
+func TestCloudProviderRoundTrip(t *testing.T) {
+	backend := newFakeProxmox(t)
+	backend.addVM(fakeVM{VmId: 9000, Name: "template", Node: "pve", Template: true})
+	backend.addVM(fakeVM{VmId: 101, Name: "k8s-default-101", Node: "pve", Status: "running"})
+	backend.addVM(fakeVM{VmId: 102, Name: "k8s-default-102", Node: "pve", Status: "running"})
+	records := []VmRecord{
+		{VmId: 101, Name: "k8s-default-101", Group: DEFAULT_GROUP, State: VM_READY},
+		{VmId: 102, Name: "k8s-default-102", Group: DEFAULT_GROUP, State: VM_PROVISIONING},
+	}
+	a := newTestAutoscaler(testConfig(), backend.client(t), &records)
+	client, _ := serveTestProvider(t, a)
+	ctx := context.Background()
+
+	groups, err := client.NodeGroups(ctx, &protos.NodeGroupsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups.GetNodeGroups()) != 2 || groups.GetNodeGroups()[1].GetId() != "gpu" || groups.GetNodeGroups()[1].GetMaxSize() != 2 {
+		t.Fatalf("NodeGroups() = %v", groups.GetNodeGroups())
+	}
+
+	forNode, err := client.NodeGroupForNode(ctx, &protos.NodeGroupForNodeRequest{Node: &protos.ExternalGrpcNode{ProviderID: providerID(102)}})
+	if err != nil || forNode.GetNodeGroup().GetId() != DEFAULT_GROUP {
+		t.Fatalf("NodeGroupForNode(102) = %v, %v", forNode, err)
+	}
+	forNode, err = client.NodeGroupForNode(ctx, &protos.NodeGroupForNodeRequest{Node: &protos.ExternalGrpcNode{Name: "control-plane"}})
+	if err != nil || forNode.GetNodeGroup().GetId() != "" {
+		t.Fatalf("NodeGroupForNode(unmanaged) = %v, %v", forNode, err)
+	}
+
+	nodes, err := client.NodeGroupNodes(ctx, &protos.NodeGroupNodesRequest{Id: DEFAULT_GROUP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes.GetInstances()) != 2 || nodes.GetInstances()[1].GetStatus().GetInstanceState() != protos.InstanceStatus_instanceCreating {
+		t.Fatalf("NodeGroupNodes() = %v", nodes.GetInstances())
+	}
+
+	if size := targetSize(t, client, DEFAULT_GROUP); size != 2 {
+		t.Fatalf("target size = %d, want 2", size)
+	}
+
+	// A dry-run scale-up only reads from proxmox
+	if _, err := client.NodeGroupIncreaseSize(ctx, &protos.NodeGroupIncreaseSizeRequest{Id: DEFAULT_GROUP, Delta: 1}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		return backend.count(`^GET /cluster/nextid$`) == 1 && targetSize(t, client, DEFAULT_GROUP) == 2
+	})
+	if writes := backend.count(`^(POST|PUT|DELETE) `); writes != 0 {
+		t.Fatalf("dry-run scale-up sent %d writes to proxmox", writes)
+	}
+
+	if _, err := client.Refresh(ctx, &protos.RefreshRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	configMap, err := a.clientset.CoreV1().ConfigMaps(podNamespace()).Get(ctx, STATUS_CONFIGMAP, metav1.GetOptions{})
+	if err != nil || !strings.Contains(configMap.Data[STATUS_KEY], "Managed VMs: 2") {
+		t.Fatalf("status ConfigMap = %v, %v", configMap, err)
+	}
+}
+
+func TestCloudProviderErrors(t *testing.T) {
+	backend := newFakeProxmox(t)
+	records := []VmRecord{{VmId: 101, Name: "k8s-gpu-101", Group: "gpu"}}
+	a := newTestAutoscaler(testConfig(), backend.client(t), &records)
+	client, _ := serveTestProvider(t, a)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		call func() error
+		code codes.Code
+	}{
+		{"unknown group", func() error {
+			_, err := client.NodeGroupTargetSize(ctx, &protos.NodeGroupTargetSizeRequest{Id: "missing"})
+			return err
+		}, codes.NotFound},
+		{"increase above max", func() error {
+			_, err := client.NodeGroupIncreaseSize(ctx, &protos.NodeGroupIncreaseSizeRequest{Id: "gpu", Delta: 2})
+			return err
+		}, codes.InvalidArgument},
+		{"increase not positive", func() error {
+			_, err := client.NodeGroupIncreaseSize(ctx, &protos.NodeGroupIncreaseSizeRequest{Id: "gpu", Delta: 0})
+			return err
+		}, codes.InvalidArgument},
+		{"decrease below pending", func() error {
+			_, err := client.NodeGroupDecreaseTargetSize(ctx, &protos.NodeGroupDecreaseTargetSizeRequest{Id: "gpu", Delta: -1})
+			return err
+		}, codes.InvalidArgument},
+		{"delete below min", func() error {
+			_, err := client.NodeGroupDeleteNodes(ctx, &protos.NodeGroupDeleteNodesRequest{Id: DEFAULT_GROUP, Nodes: []*protos.ExternalGrpcNode{{Name: "k8s-gpu-101"}}})
+			return err
+		}, codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := status.Code(tt.call()); code != tt.code {
+				t.Fatalf("code = %s, want %s", code, tt.code)
+			}
+		})
+	}
+}
+
+/*
+Requests beyond the old queue length must
+not block the RPC and VMs that workers
+picked up must keep counting towards
+the target size.
+*/
+func TestCloudProviderIncreaseSizeWhileBusy(t *testing.T) {
+	backend := newFakeProxmox(t)
+	backend.addVM(fakeVM{VmId: 9000, Name: "template", Node: "pve", Template: true})
+	gate := make(chan struct{})
+	backend.gate = gate
+	var records []VmRecord
+	a := newTestAutoscaler(testConfig(), backend.client(t), &records)
+	client, provider := serveTestProvider(t, a)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.NodeGroupIncreaseSize(ctx, &protos.NodeGroupIncreaseSizeRequest{Id: DEFAULT_GROUP, Delta: 150}); err != nil {
+		t.Fatal(err)
+	}
+
+	// All workers are now stuck in proxmox with one VM each
+	waitFor(t, func() bool {
+		provider.mu.Lock()
+		defer provider.mu.Unlock()
+		return provider.pending[DEFAULT_GROUP] == 150-a.cfg.MaxConcurrentProvisions
+	})
+	if size := targetSize(t, client, DEFAULT_GROUP); size != 150 {
+		t.Fatalf("target size while workers are busy = %d, want 150", size)
+	}
+
+	if _, err := client.NodeGroupDecreaseTargetSize(ctx, &protos.NodeGroupDecreaseTargetSizeRequest{Id: DEFAULT_GROUP, Delta: -7}); err != nil {
+		t.Fatal(err)
+	}
+	if size := targetSize(t, client, DEFAULT_GROUP); size != 143 {
+		t.Fatalf("target size after decrease = %d, want 143", size)
+	}
+
+	backend.mu.Lock()
+	backend.gate = nil
+	backend.mu.Unlock()
+	close(gate)
+	waitFor(t, func() bool { return targetSize(t, client, DEFAULT_GROUP) == 0 })
+	if planned := backend.count(`^GET /cluster/nextid$`); planned != 143 {
+		t.Fatalf("planned %d scale-ups, want 143", planned)
+	}
+}
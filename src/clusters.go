@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"sort"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+)
+
+const (
+	DEFAULT_CLUSTER = "default"
+
+	CLUSTER_SELECTION_PRIORITY = "priority"
+	CLUSTER_SELECTION_CAPACITY = "capacity"
+)
+
+/*
+ProxmoxCluster is a separate PVE cluster
+used as a capacity pool. The first
+cluster is always "default" and uses
+PM_API_URL, PM_USER, PM_PASS and PM_OTP.
+More clusters can be added as a JSON
+list in proxmoxClusters. Their
+credentials are read from the secret
+keys named in userKey, passKey and
+otpKey. TemplateName, NodeName and
+FallbackNodes replace those of the node
+groups on this cluster when set.
+*/
+type ProxmoxCluster struct {
+	Name          string   `json:"name"`
+	ApiUrl        string   `json:"apiUrl"`
+	UserKey       string   `json:"userKey"`
+	PassKey       string   `json:"passKey"`
+	OtpKey        string   `json:"otpKey"`
+	Priority      int      `json:"priority"`
+	TemplateName  string   `json:"templateName"`
+	NodeName      string   `json:"nodeName"`
+	FallbackNodes []string `json:"fallbackNodes"`
+}
+
+// Builds the default cluster followed by any configured in proxmoxClusters
+func loadClusters() ([]ProxmoxCluster, error) {
+	clusters := []ProxmoxCluster{{
+		Name:    DEFAULT_CLUSTER,
+		ApiUrl:  getValueOf("PM_API_URL", ""),
+		UserKey: "PM_USER",
+		PassKey: "PM_PASS",
+		OtpKey:  "PM_OTP",
+	}}
+	raw := getValueOf("proxmoxClusters", "")
+	if len(raw) == 0 {
+		raw = "[]"
+	}
+	var extra []ProxmoxCluster
+	if err := json.Unmarshal([]byte(raw), &extra); err != nil {
+		return nil, errors.New("proxmoxClusters is not a valid JSON list: " + err.Error())
+	}
+	for _, cluster := range extra {
+		if len(cluster.Name) == 0 {
+			return nil, errors.New("Cluster name not specified in proxmoxClusters!")
+		}
+		for _, existing := range clusters {
+			if existing.Name == cluster.Name {
+				return nil, errors.New("Proxmox cluster '" + cluster.Name + "' is defined more than once!")
+			}
+		}
+		if len(cluster.ApiUrl) == 0 || len(cluster.UserKey) == 0 || len(cluster.PassKey) == 0 {
+			return nil, errors.New("apiUrl, userKey and passKey are required for proxmox cluster '" + cluster.Name + "'!")
+		}
+		clusters = append(clusters, cluster)
+	}
+	return clusters, nil
+}
+
+/*
+orderedClusters returns the clusters
+by descending priority. Clusters with
+the same priority keep their order.
+*/
+func (c *Config) orderedClusters() []ProxmoxCluster {
+	clusters := append([]ProxmoxCluster{}, c.Clusters...)
+	sort.SliceStable(clusters, func(i, j int) bool {
+		return clusters[i].Priority > clusters[j].Priority
+	})
+	return clusters
+}
+
+// Returns a copy of the group with the overrides of the cluster
+func (g *NodeGroup) onCluster(cluster ProxmoxCluster) NodeGroup {
+	group := *g
+	if len(cluster.TemplateName) != 0 {
+		group.TemplateName = cluster.TemplateName
+	}
+	if len(cluster.NodeName) != 0 {
+		group.NodeName = cluster.NodeName
+	}
+	if cluster.FallbackNodes != nil {
+		group.FallbackNodes = cluster.FallbackNodes
+	}
+	return group
+}
+
+/*
+CreateClients creates a client for
+every configured cluster. Clusters that
+can not be reached are logged and left
+out, connectClusters retries them.
+*/
+func CreateClients(cfg *Config) map[string]*proxmox.Client {
+	clients := map[string]*proxmox.Client{}
+	for _, cluster := range cfg.Clusters {
+		client, err := CreateClient(cfg, cluster)
+		if err != nil {
+			ColorPrint(WARN, "Proxmox cluster %s is unavailable: %v", cluster.Name, err)
+			continue
+		}
+		clients[cluster.Name] = client
+	}
+	return clients
+}
+
+/*
+connectClusters retries the clusters
+that could not be reached so far and
+checks their templates once they are
+back.
+*/
+func (a *Autoscaler) connectClusters() {
+	cfg := a.config()
+	clients := maps.Clone(a.proxmoxClients())
+	connected := false
+	for _, cluster := range cfg.Clusters {
+		if clients[cluster.Name] != nil {
+			continue
+		}
+		client, err := CreateClient(cfg, cluster)
+		if err != nil {
+			ColorPrint(WARN, "Proxmox cluster %s is still unavailable: %v", cluster.Name, err)
+			continue
+		}
+		ColorPrint(INFO, "Proxmox cluster %s is reachable again", cluster.Name)
+		clients[cluster.Name] = client
+		connected = true
+	}
+	if connected {
+		a.cfgMu.Lock()
+		a.clients = clients
+		a.cfgMu.Unlock()
+		a.checkClusters()
+	}
+}
+
+/*
+checkClusters validates the templates
+on every cluster and keeps the clusters
+that can not take new VMs out of the
+placement. It fails only when none of
+them can.
+*/
+func (a *Autoscaler) checkClusters() error {
+	unavailable, err := ValidateTemplates(a.proxmoxClients(), a.config())
+	a.cfgMu.Lock()
+	a.unavailable = unavailable
+	a.cfgMu.Unlock()
+	return err
+}
+
+// Returns the clients of the clusters that can take new VMs
+func (a *Autoscaler) placementClients() map[string]*proxmox.Client {
+	a.cfgMu.RLock()
+	defer a.cfgMu.RUnlock()
+	clients := map[string]*proxmox.Client{}
+	for name, client := range a.clients {
+		if _, ok := a.unavailable[name]; !ok {
+			clients[name] = client
+		}
+	}
+	return clients
+}
+
+// Returns the client of the cluster a VM record belongs to
+func (a *Autoscaler) clusterClient(name string) (*proxmox.Client, error) {
+	if len(name) == 0 {
+		name = DEFAULT_CLUSTER
+	}
+	client, ok := a.proxmoxClients()[name]
+	if !ok {
+		for _, cluster := range a.config().Clusters {
+			if cluster.Name == name {
+				return nil, fmt.Errorf("proxmox cluster '%s' is unavailable", name)
+			}
+		}
+		return nil, fmt.Errorf("proxmox cluster '%s' is not configured", name)
+	}
+	return client, nil
+}
+
+// Where a new VM of a node group is going to be cloned
+type Placement struct {
+	Cluster     ProxmoxCluster
+	Client      *proxmox.Client
+	Group       NodeGroup
+	Reservation *Reservation
+}
+
+/*
+placeVM picks the cluster and node for
+a new VM of the group. With the
+priority selection the first cluster
+by priority that has room is used.
+With the capacity selection the
+cluster whose chosen node has the
+most free memory wins. The returned
+group carries the template and node
+of that cluster. Clusters without a
+client are skipped. With reserved set the
+room of the VM is reserved on the chosen
+node until the caller releases it.
+*/
+func placeVM(clients map[string]*proxmox.Client, cfg *Config, group *NodeGroup, reserved *Reservations) (*Placement, error) {
+	if reserved != nil {
+		reserved.placing.Lock()
+		defer reserved.placing.Unlock()
+	}
+	var best *Placement
+	bestFree := -1.0
+	var errs []error
+	for _, cluster := range cfg.orderedClusters() {
+		client := clients[cluster.Name]
+		if client == nil {
+			errs = append(errs, fmt.Errorf("cluster %s is unavailable", cluster.Name))
+			continue
+		}
+		candidate := group.onCluster(cluster)
+		// Only used to read the size of the VM
+		sizing, err := RenderCloudInit(candidate.CloudInitConfig, cfg.cloudInitData(&candidate, 0, candidate.Name, nil))
+		if err != nil {
+			return nil, err
+		}
+		res, free, err := PlaceVM(client, cfg, &candidate, sizing, reserved)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cluster %s: %w", cluster.Name, err))
+			continue
+		}
+		candidate.NodeName = res.Node
+		placement := &Placement{Cluster: cluster, Client: client, Group: candidate, Reservation: res}
+		if cfg.ClusterSelection == CLUSTER_SELECTION_PRIORITY {
+			best = placement
+			break
+		}
+		if free > bestFree {
+			best = placement
+			bestFree = free
+		}
+	}
+	if best == nil {
+		return nil, errors.Join(errs...)
+	}
+	if reserved != nil && cfg.CapacityCheck {
+		reserved.Add(best.Reservation)
+	}
+	return best, nil
+}
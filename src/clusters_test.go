@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+)
+
+// Returns a template that passes CheckTemplates on the fake backend
+func testTemplate() fakeVM {
+	return fakeVM{VmId: 9000, Name: "template", Node: "pve", Template: true, Config: map[string]interface{}{
+		"agent": "1",
+		"scsi0": "local-lvm:base-9000-disk-0,size=16G",
+		"ide2":  "local-lvm:vm-9000-cloudinit,media=cdrom",
+	}}
+}
+
+// Builds a config with the default cluster and a second one on the fake backend
+func testClusters(backend *fakeProxmox) *Config {
+	cfg := testConfig()
+	cfg.Clusters = []ProxmoxCluster{
+		{Name: DEFAULT_CLUSTER, ApiUrl: "http://127.0.0.1:1/api2/json", Priority: 10},
+		{Name: "second", ApiUrl: backend.server.URL + "/api2/json", UserKey: "PM_USER", PassKey: "PM_PASS"},
+	}
+	return cfg
+}
+
+func TestCreateClientsSkipsUnreachable(t *testing.T) {
+	backend := newFakeProxmox(t)
+	cfg := testClusters(backend)
+
+	if _, err := CreateClient(cfg, cfg.Clusters[0]); err == nil || !strings.Contains(err.Error(), "login error") {
+		t.Fatalf("CreateClient() of an unreachable cluster = %v", err)
+	}
+	clients := CreateClients(cfg)
+	if _, ok := clients[DEFAULT_CLUSTER]; ok || clients["second"] == nil {
+		t.Fatalf("CreateClients() = %v, want only the second cluster", clients)
+	}
+}
+
+/*
+A cluster that is unreachable or can not
+clone its templates is left out of the
+placement while the others keep taking
+new VMs.
+*/
+func TestUnavailableClusters(t *testing.T) {
+	backend := newFakeProxmox(t)
+	backend.addVM(testTemplate())
+	cfg := testClusters(backend)
+	var records []VmRecord
+	a := newTestAutoscaler(cfg, nil, &records)
+	a.clients = CreateClients(cfg)
+
+	if err := a.checkClusters(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.unavailable[DEFAULT_CLUSTER]; !ok || len(a.unavailable) != 1 {
+		t.Fatalf("unavailable = %v, want only the default cluster", a.unavailable)
+	}
+	placement, err := placeVM(a.placementClients(), cfg, &cfg.NodeGroups[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if placement.Cluster.Name != "second" {
+		t.Fatalf("VM placed on cluster %s, want second", placement.Cluster.Name)
+	}
+	if _, err := a.clusterClient(DEFAULT_CLUSTER); err == nil || !strings.Contains(err.Error(), "unavailable") {
+		t.Fatalf("clusterClient() = %v", err)
+	}
+
+	// A missing template takes the last cluster out as well
+	backend.mu.Lock()
+	delete(backend.vms, 9000)
+	backend.mu.Unlock()
+	if err := a.checkClusters(); err == nil {
+		t.Fatal("checkClusters() passed without any usable cluster")
+	}
+	_, err = placeVM(a.placementClients(), cfg, &cfg.NodeGroups[0], nil)
+	if err == nil || !strings.Contains(err.Error(), "cluster second is unavailable") {
+		t.Fatalf("placeVM() = %v", err)
+	}
+	if errors.Is(err, ErrInfrastructureFull) {
+		t.Fatal("unavailable clusters were reported as full")
+	}
+}
+
+func TestConnectClusters(t *testing.T) {
+	backend := newFakeProxmox(t)
+	backend.addVM(testTemplate())
+	cfg := testClusters(backend)
+	var records []VmRecord
+	a := newTestAutoscaler(cfg, nil, &records)
+	a.clients = map[string]*proxmox.Client{}
+	a.unavailable = map[string]string{"second": "cluster is unreachable"}
+
+	a.ApplyConfig(cfg)
+	if a.clients["second"] == nil {
+		t.Fatal("the reachable cluster was not connected")
+	}
+	if _, ok := a.unavailable["second"]; ok {
+		t.Fatalf("unavailable = %v after the cluster came back", a.unavailable)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const usage = `Usage: app [command] [flags]
+
+Commands:
+  run                               Run the autoscaling loop (default)
+  status                            List managed VMs with their VM and node status
+  scale-up --group X --count N      Add N VMs from node group X
+  scale-down --node Y               Remove the managed VM backing node Y
+  validate-config [--skip-templates]
+                                    Validate the mounted config and templates and exit
+  reconcile [--dry-run]             Run a single autoscaling cycle
+  rebuild-state [--dry-run]         Recover the managed VM records from proxmox
+  grpc-server --address A           Serve the cluster-autoscaler externalgrpc cloud provider
+              [--cert C --key K [--cacert CA]]
+`
+
+/*
+runCommand dispatches the operator
+subcommands. Each subcommand parses
+its own flags and exits non-zero
+on failure.
+*/
+func runCommand(command string, args []string) {
+	switch command {
+	case "run":
+		run()
+	case "status":
+		exitOnError(statusCommand(args))
+	case "scale-up":
+		exitOnError(scaleUpCommand(args))
+	case "scale-down":
+		exitOnError(scaleDownCommand(args))
+	case "validate-config":
+		exitOnError(validateConfigCommand(args))
+	case "reconcile":
+		exitOnError(reconcileCommand(args))
+	case "rebuild-state":
+		exitOnError(rebuildStateCommand(args))
+	case "grpc-server":
+		exitOnError(grpcServerCommand(args))
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		exitOnError(fmt.Errorf("unknown command '%s'", command))
+	}
+}
+
+// Prints the error and exits with a non-zero code
+func exitOnError(err error) {
+	if err != nil {
+		ColorPrint(WARN, "%v", err)
+		os.Exit(1)
+	}
+}
+
+func statusCommand(args []string) error {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	flags.Parse(args)
+
+	a := NewAutoscaler()
+	defer a.Close()
+	records, err := ListVmInfo(a.connStr)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VMID\tNAME\tGROUP\tCLUSTER\tPVE NODE\tSTATE\tVM STATUS\tK8S STATUS\tREASON")
+	for _, record := range records {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", record.VmId, record.Name, record.Group, record.Cluster, record.Node, record.State, a.vmStatus(record), a.nodeStatus(record.Name), record.Reason)
+	}
+	return w.Flush()
+}
+
+// Returns the proxmox power state of a managed VM
+func (a *Autoscaler) vmStatus(record VmRecord) string {
+	vmr := proxmox.NewVmRef(record.VmId)
+	vmr.SetNode(record.Node)
+	vmr.SetVmType("qemu")
+	client, err := a.clusterClient(record.Cluster)
+	if err != nil {
+		return "unknown"
+	}
+	vmState, err := client.GetVmState(vmr)
+	if err != nil {
+		return "unknown"
+	}
+	if status, ok := vmState["status"].(string); ok {
+		return status
+	}
+	return "unknown"
+}
+
+// Returns the Ready condition of a kubernetes node
+func (a *Autoscaler) nodeStatus(name string) string {
+	node, err := a.clientset.CoreV1().Nodes().Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return "NotFound"
+	}
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			if condition.Status == v1.ConditionTrue {
+				return "Ready"
+			}
+			return "NotReady"
+		}
+	}
+	return "Unknown"
+}
+
+func scaleUpCommand(args []string) error {
+	flags := flag.NewFlagSet("scale-up", flag.ExitOnError)
+	groupName := flags.String("group", DEFAULT_GROUP, "node group to add VMs to")
+	count := flags.Int("count", 1, "number of VMs to add")
+	dryRun := flags.Bool("dry-run", false, "only log the actions that would be taken")
+	flags.Parse(args)
+	if *count < 1 {
+		return fmt.Errorf("--count must be at least 1")
+	}
+
+	a := NewAutoscaler()
+	defer a.Close()
+	cfg := a.config()
+	cfg.DryRun = cfg.DryRun || *dryRun
+	group := cfg.Group(*groupName)
+	if group == nil {
+		return fmt.Errorf("node group '%s' is not configured", *groupName)
+	}
+	if cfg.DryRun {
+		PlanScaleUp(a.placementClients(), cfg, group, *count, 0, 0)
+		return nil
+	}
+	ctx, stop := shutdownContext()
+	defer stop()
+	return provisionError(a.Provision(ctx, group, *count))
+}
+
+func scaleDownCommand(args []string) error {
+	flags := flag.NewFlagSet("scale-down", flag.ExitOnError)
+	node := flags.String("node", "", "kubernetes node name of the VM to remove")
+	dryRun := flags.Bool("dry-run", false, "only log the actions that would be taken")
+	flags.Parse(args)
+	if len(*node) == 0 {
+		return fmt.Errorf("--node is required")
+	}
+
+	a := NewAutoscaler()
+	defer a.Close()
+	cfg := a.config()
+	cfg.DryRun = cfg.DryRun || *dryRun
+	return a.ScaleDown(*node)
+}
+
+func validateConfigCommand(args []string) error {
+	flags := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	skipTemplates := flags.Bool("skip-templates", false, "do not connect to proxmox to validate the templates")
+	flags.Parse(args)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	ColorPrint(INFO, "Config is valid. cpuLimit: %d, memoryLimit: %d, dryRun: %t", cfg.CpuLimit, cfg.MemoryLimit, cfg.DryRun)
+	for _, group := range cfg.NodeGroups {
+		ColorPrint(INFO, "Node group '%s': template '%s' on node '%s' using '%s'", group.Name, group.TemplateName, group.NodeName, group.CloudInitPath)
+	}
+	if *skipTemplates {
+		return nil
+	}
+	unavailable, err := ValidateTemplates(CreateClients(cfg), cfg)
+	if err != nil {
+		return err
+	}
+	if len(unavailable) != 0 {
+		return fmt.Errorf("%d of %d proxmox cluster(s) can not take new VMs", len(unavailable), len(cfg.Clusters))
+	}
+	return nil
+}
+
+func reconcileCommand(args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only log the actions that would be taken")
+	flags.Parse(args)
+
+	a := NewAutoscaler()
+	defer a.Close()
+	cfg := a.config()
+	cfg.DryRun = cfg.DryRun || *dryRun
+	ctx, stop := shutdownContext()
+	defer stop()
+	a.Reconcile(ctx, false)
+	return nil
+}
+
+func rebuildStateCommand(args []string) error {
+	flags := flag.NewFlagSet("rebuild-state", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only log the records that would be saved")
+	flags.Parse(args)
+
+	a := NewAutoscaler()
+	defer a.Close()
+	recovered, err := a.RebuildState(*dryRun)
+	if err != nil {
+		return err
+	}
+	ColorPrint(INFO, "Recovered %d managed VM(s) from proxmox", recovered)
+	return nil
+}
+
+func grpcServerCommand(args []string) error {
+	flags := flag.NewFlagSet("grpc-server", flag.ExitOnError)
+	address := flags.String("address", ":8086", "address to listen on")
+	cert := flags.String("cert", "", "TLS certificate file")
+	key := flags.String("key", "", "TLS key file")
+	caCert := flags.String("cacert", "", "CA used to verify client certificates")
+	flags.Parse(args)
+
+	a := NewAutoscaler()
+	defer a.Close()
+	if err := a.checkClusters(); err != nil {
+		return err
+	}
+	watcher, err := WatchConfig()
+	if err != nil {
+		return err
+	}
+	ctx, stop := shutdownContext()
+	defer stop()
+	if err := ServeMetrics(ctx, a.config().MetricsAddress); err != nil {
+		return err
+	}
+	return ServeCloudProvider(ctx, a, watcher, *address, *cert, *key, *caCert)
+}
@@ -0,0 +1,648 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+/*
+Config holds the typed settings read
+from the mounted secrets and the
+cloud-init ConfigMap. Field tags map
+each field to the key it is read from.
+*/
+type Config struct {
+	Insecure                bool             `key:"insecure"`
+	ProxmoxProxy            string           `key:"proxmoxProxy"`
+	ProxmoxCaBundle         string           `key:"proxmoxCaBundle"`
+	RequestTimeout          int              `key:"requestTimeout"`
+	TicketRefresh           int              `key:"ticketRefresh"`
+	Clusters                []ProxmoxCluster `key:"proxmoxClusters"`
+	ClusterSelection        string           `key:"clusterSelection"`
+	Debug                   bool             `key:"debug"`
+	DryRun                  bool             `key:"dryRun"`
+	KeepFailedVMs           bool             `key:"keepFailedVMs"`
+	CapacityCheck           bool             `key:"capacityCheck"`
+	MemoryOvercommit        float64          `key:"memoryOvercommit"`
+	CpuOvercommit           float64          `key:"cpuOvercommit"`
+	MetricsAddress          string           `key:"metricsAddress"`
+	ScaleUpStep             int              `key:"scaleUpStep"`
+	MaxConcurrentProvisions int              `key:"maxConcurrentProvisions"`
+	MaxProxmoxRequests      int              `key:"maxProxmoxRequests"`
+	TaskTimeout             int              `key:"taskTimeout"`
+	CloneTimeout            int              `key:"cloneTimeout"`
+	StartTimeout            int              `key:"startTimeout"`
+	AgentTimeout            int              `key:"agentTimeout"`
+	IpTimeout               int              `key:"ipTimeout"`
+	JoinTimeout             int              `key:"joinTimeout"`
+	DestroyTimeout          int              `key:"destroyTimeout"`
+	ShutdownGracePeriod     int              `key:"shutdownGracePeriod"`
+	VmShutdownTimeout       int              `key:"vmShutdownTimeout"`
+	MemoryLimit             int              `key:"memoryLimit"`
+	CpuLimit                int              `key:"cpuLimit"`
+	NodeName                string           `key:"nodeName"`
+	TemplateName            string           `key:"templateName"`
+	JoinCommand             string           `key:"joinCommand"`
+	SshUser                 string           `key:"sshUser"`
+	NamePrefix              string           `key:"namePrefix"`
+	InstanceId              string           `key:"instanceId"`
+	ProxmoxTags             string           `key:"proxmoxTags"`
+	ProxmoxPool             string           `key:"proxmoxPool"`
+	NamePattern             string           `key:"namePattern"`
+	SshPublicKeys           string           `key:"sshPublicKeys"`
+	IpInterfaceRegex        string           `key:"ipInterfaceRegex"`
+	IpExcludeInterfaceRegex string           `key:"ipExcludeInterfaceRegex"`
+	IpCidrAllowlist         string           `key:"ipCidrAllowlist"`
+	IpFamily                string           `key:"ipFamily"`
+	IpamCidr                string           `key:"ipamCidr"`
+	IpamGateway             string           `key:"ipamGateway"`
+	IpamReserved            string           `key:"ipamReserved"`
+	IpamNameserver          string           `key:"ipamNameserver"`
+	AnsibleTag              string           `key:"ansibleTag"`
+	AnsibleRepo             string           `key:"ansibleRepo"`
+	AnsiblePlaybook         string           `key:"ansiblePlaybook"`
+	AnsibleRequirements     string           `key:"ansibleRequirements"`
+	AnsibleExtraVarsFile    string           `key:"ansibleExtraVarsFile"`
+	AnsibleTimeout          int              `key:"ansibleTimeout"`
+	AnsibleRunLogs          int              `key:"ansibleRunLogs"`
+	AnsibleRetries          int              `key:"ansibleRetries"`
+	AnsibleRetryBackoff     int              `key:"ansibleRetryBackoff"`
+	AnsibleOnTaskFailure    string           `key:"ansibleOnTaskFailure"`
+	CloudInitConfig         []byte           `key:"cloud-init"`
+	NodeGroups              []NodeGroup      `key:"nodeGroups"`
+}
+
+/*
+NodeGroup is a named VM profile that
+scale-ups can target. The first group
+is always "default" and is built from
+templateName, nodeName and the
+cloud-init ConfigMap. More groups can
+be added as a JSON list in nodeGroups;
+unset fields fall back to the defaults.
+MinSize and MaxSize bound the group
+when it is scaled through gRPC.
+*/
+type NodeGroup struct {
+	Name            string            `json:"name"`
+	TemplateName    string            `json:"templateName"`
+	NodeName        string            `json:"nodeName"`
+	CloudInitPath   string            `json:"cloudInitPath"`
+	MinSize         int               `json:"minSize"`
+	MaxSize         int               `json:"maxSize"`
+	FullClone       *bool             `json:"fullClone"`
+	Storage         string            `json:"storage"`
+	StorageByNode   map[string]string `json:"storageByNode"`
+	ResizeDiskName  string            `json:"resizeDisk"`
+	ResizeDiskBy    string            `json:"diskResize"`
+	HaGroup         string            `json:"haGroup"`
+	FallbackNodes   []string          `json:"fallbackNodes"`
+	CloudInitConfig []byte            `json:"-"`
+}
+
+const DEFAULT_GROUP = "default"
+
+/*
+loadConfig reads every setting and
+validates that all required inputs
+are in place and are using the
+correct formats.
+*/
+func loadConfig() (*Config, error) {
+	var err error
+	cfg := &Config{}
+	if cfg.Insecure, err = strconv.ParseBool(getValueOf("insecure", "false")); err != nil {
+		return nil, err
+	}
+	cfg.ProxmoxProxy = getValueOf("proxmoxProxy", "")
+	if len(cfg.ProxmoxProxy) != 0 {
+		if _, err = url.ParseRequestURI(cfg.ProxmoxProxy); err != nil {
+			return nil, errors.New("proxmoxProxy is not a valid URL: " + err.Error())
+		}
+	}
+	cfg.ProxmoxCaBundle = getValueOf("proxmoxCaBundle", "")
+	if _, err = cfg.tlsConfig(); err != nil {
+		return nil, err
+	}
+	if cfg.RequestTimeout, err = positiveInt("requestTimeout", "60"); err != nil {
+		return nil, err
+	}
+	if cfg.TicketRefresh, err = positiveInt("ticketRefresh", "5400"); err != nil {
+		return nil, err
+	}
+	if cfg.Clusters, err = loadClusters(); err != nil {
+		return nil, err
+	}
+	cfg.ClusterSelection = getValueOf("clusterSelection", CLUSTER_SELECTION_PRIORITY)
+	if cfg.ClusterSelection != CLUSTER_SELECTION_PRIORITY && cfg.ClusterSelection != CLUSTER_SELECTION_CAPACITY {
+		return nil, errors.New("clusterSelection must be " + CLUSTER_SELECTION_PRIORITY + " or " + CLUSTER_SELECTION_CAPACITY + "!")
+	}
+	if cfg.Debug, err = strconv.ParseBool(getValueOf("debug", "false")); err != nil {
+		return nil, err
+	}
+	if cfg.DryRun, err = strconv.ParseBool(getValueOf("dryRun", "false")); err != nil {
+		return nil, err
+	}
+	if cfg.KeepFailedVMs, err = strconv.ParseBool(getValueOf("keepFailedVMs", "false")); err != nil {
+		return nil, err
+	}
+	if cfg.CapacityCheck, err = strconv.ParseBool(getValueOf("capacityCheck", "false")); err != nil {
+		return nil, err
+	}
+	if cfg.MemoryOvercommit, err = positiveFloat("memoryOvercommit", "1"); err != nil {
+		return nil, err
+	}
+	if cfg.CpuOvercommit, err = positiveFloat("cpuOvercommit", "4"); err != nil {
+		return nil, err
+	}
+	cfg.MetricsAddress = getValueOf("metricsAddress", ":8087")
+	if cfg.TaskTimeout, err = strconv.Atoi(getValueOf("taskTimeout", "300")); err != nil {
+		return nil, err
+	}
+	if cfg.ScaleUpStep, err = positiveInt("scaleUpStep", "1"); err != nil {
+		return nil, err
+	}
+	if cfg.MaxConcurrentProvisions, err = positiveInt("maxConcurrentProvisions", "3"); err != nil {
+		return nil, err
+	}
+	if cfg.MaxProxmoxRequests, err = positiveInt("maxProxmoxRequests", "2"); err != nil {
+		return nil, err
+	}
+	// Deadlines of the provisioning phases in seconds
+	if cfg.CloneTimeout, err = positiveInt("cloneTimeout", "900"); err != nil {
+		return nil, err
+	}
+	if cfg.StartTimeout, err = positiveInt("startTimeout", "300"); err != nil {
+		return nil, err
+	}
+	if cfg.AgentTimeout, err = positiveInt("agentTimeout", "600"); err != nil {
+		return nil, err
+	}
+	if cfg.IpTimeout, err = positiveInt("ipTimeout", "600"); err != nil {
+		return nil, err
+	}
+	if cfg.JoinTimeout, err = positiveInt("joinTimeout", "1800"); err != nil {
+		return nil, err
+	}
+	if cfg.DestroyTimeout, err = positiveInt("destroyTimeout", "300"); err != nil {
+		return nil, err
+	}
+	if cfg.ShutdownGracePeriod, err = positiveInt("shutdownGracePeriod", "240"); err != nil {
+		return nil, err
+	}
+	if cfg.VmShutdownTimeout, err = positiveInt("vmShutdownTimeout", "120"); err != nil {
+		return nil, err
+	}
+	memLimit := getValueOf("memoryLimit", "")
+	if len(memLimit) == 0 {
+		return nil, errors.New("memoryLimit not specified in config!")
+	}
+	if cfg.MemoryLimit, err = strconv.Atoi(memLimit); err != nil {
+		return nil, err
+	}
+	cLimit := getValueOf("cpuLimit", "")
+	if len(cLimit) == 0 {
+		return nil, errors.New("cpuLimit not specified in config!")
+	}
+	if cfg.CpuLimit, err = strconv.Atoi(cLimit); err != nil {
+		return nil, err
+	}
+	cfg.NodeName = getValueOf("nodeName", "")
+	if len(cfg.NodeName) == 0 {
+		return nil, errors.New("Node name not specified in config!")
+	}
+	cfg.TemplateName = getValueOf("templateName", "")
+	if len(cfg.TemplateName) == 0 {
+		return nil, errors.New("Template name not specified in config!")
+	}
+	cfg.JoinCommand = getValueOf("joinCommand", "")
+	if len(cfg.JoinCommand) == 0 {
+		return nil, errors.New("joinCommand not specified in config!")
+	}
+	cfg.SshUser = getValueOf("sshUser", "admin")
+	cfg.NamePrefix = getValueOf("namePrefix", "k8s")
+	cfg.InstanceId = getValueOf("instanceId", AUTOSCALER_NAME)
+	cfg.ProxmoxTags = getValueOf("proxmoxTags", "")
+	if err = validateTags(cfg.ProxmoxTags); err != nil {
+		return nil, err
+	}
+	cfg.ProxmoxPool = getValueOf("proxmoxPool", "")
+	cfg.NamePattern = getValueOf("namePattern", DEFAULT_NAME_PATTERN)
+	if _, err = renderName(cfg.NamePattern, NameData{Prefix: cfg.NamePrefix, Group: DEFAULT_GROUP, VmId: 100, Suffix: randomSuffix()}); err != nil {
+		return nil, errors.New("namePattern is invalid: " + err.Error())
+	}
+	cfg.SshPublicKeys = getValueOf("sshPublicKeys", "")
+	cfg.IpInterfaceRegex = getValueOf("ipInterfaceRegex", DEFAULT_INTERFACE_REGEX)
+	cfg.IpExcludeInterfaceRegex = getValueOf("ipExcludeInterfaceRegex", DEFAULT_EXCLUDE_INTERFACE_REGEX)
+	cfg.IpCidrAllowlist = getValueOf("ipCidrAllowlist", "")
+	cfg.IpFamily = getValueOf("ipFamily", IP_FAMILY_IPV4)
+	if _, err = cfg.ipSelector(); err != nil {
+		return nil, err
+	}
+	cfg.IpamCidr = getValueOf("ipamCidr", "")
+	cfg.IpamGateway = getValueOf("ipamGateway", "")
+	cfg.IpamReserved = getValueOf("ipamReserved", "")
+	cfg.IpamNameserver = getValueOf("ipamNameserver", "")
+	if _, err = cfg.ipamPool(); err != nil {
+		return nil, err
+	}
+	cfg.AnsibleTag = getValueOf("ansibleTag", "")
+	cfg.AnsibleRepo = getValueOf("ansibleRepo", "")
+	cfg.AnsiblePlaybook = getValueOf("ansiblePlaybook", "")
+	cfg.AnsibleRequirements = getValueOf("ansibleRequirements", "")
+	cfg.AnsibleExtraVarsFile = getValueOf("ansibleExtraVarsFile", "")
+	if cfg.AnsibleTimeout, err = positiveInt("ansibleTimeout", "900"); err != nil {
+		return nil, err
+	}
+	if cfg.AnsibleRunLogs, err = positiveInt("ansibleRunLogs", "20"); err != nil {
+		return nil, err
+	}
+	if cfg.AnsibleRetries, err = strconv.Atoi(getValueOf("ansibleRetries", "1")); err != nil {
+		return nil, err
+	}
+	if cfg.AnsibleRetries < 0 {
+		return nil, errors.New("ansibleRetries can not be negative!")
+	}
+	if cfg.AnsibleRetryBackoff, err = positiveInt("ansibleRetryBackoff", "10"); err != nil {
+		return nil, err
+	}
+	cfg.AnsibleOnTaskFailure = getValueOf("ansibleOnTaskFailure", ANSIBLE_ON_TASK_FAILURE_ROLLBACK)
+	switch cfg.AnsibleOnTaskFailure {
+	case ANSIBLE_ON_TASK_FAILURE_ROLLBACK, ANSIBLE_ON_TASK_FAILURE_RETRY, ANSIBLE_ON_TASK_FAILURE_RESUME:
+	default:
+		return nil, errors.New("ansibleOnTaskFailure must be rollback, retry or resume!")
+	}
+	if cfg.CloudInitConfig, err = os.ReadFile(CLOUD_INIT_PATH); err != nil {
+		return nil, errors.New("Cloud-Init config not found. Error: " + err.Error())
+	}
+	if cfg.NodeGroups, err = loadNodeGroups(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Builds the default group followed by any configured in nodeGroups
+func loadNodeGroups(cfg *Config) ([]NodeGroup, error) {
+	minSize, err := strconv.Atoi(getValueOf("minSize", "0"))
+	if err != nil {
+		return nil, err
+	}
+	maxSize, err := strconv.Atoi(getValueOf("maxSize", "10"))
+	if err != nil {
+		return nil, err
+	}
+	if minSize > maxSize {
+		return nil, errors.New("minSize is larger than maxSize!")
+	}
+	fullClone, err := strconv.ParseBool(getValueOf("fullClone", "true"))
+	if err != nil {
+		return nil, err
+	}
+	storageByNode := map[string]string{}
+	if raw := getValueOf("cloneStorageByNode", ""); len(raw) != 0 {
+		if err := json.Unmarshal([]byte(raw), &storageByNode); err != nil {
+			return nil, errors.New("cloneStorageByNode is not a valid JSON object: " + err.Error())
+		}
+	}
+	groups := []NodeGroup{{
+		Name:            DEFAULT_GROUP,
+		TemplateName:    cfg.TemplateName,
+		NodeName:        cfg.NodeName,
+		CloudInitPath:   CLOUD_INIT_PATH,
+		MinSize:         minSize,
+		MaxSize:         maxSize,
+		FullClone:       &fullClone,
+		Storage:         getValueOf("cloneStorage", ""),
+		StorageByNode:   storageByNode,
+		ResizeDiskName:  getValueOf("resizeDisk", "scsi0"),
+		ResizeDiskBy:    getValueOf("diskResize", ""),
+		HaGroup:         getValueOf("haGroup", ""),
+		FallbackNodes:   splitNodes(getValueOf("fallbackNodes", "")),
+		CloudInitConfig: cfg.CloudInitConfig,
+	}}
+	raw := getValueOf("nodeGroups", "")
+	if len(raw) == 0 {
+		raw = "[]"
+	}
+	var extra []NodeGroup
+	if err := json.Unmarshal([]byte(raw), &extra); err != nil {
+		return nil, errors.New("nodeGroups is not a valid JSON list: " + err.Error())
+	}
+	for _, group := range extra {
+		if len(group.Name) == 0 {
+			return nil, errors.New("Node group name not specified in nodeGroups!")
+		}
+		for _, existing := range groups {
+			if existing.Name == group.Name {
+				return nil, errors.New("Node group '" + group.Name + "' is defined more than once!")
+			}
+		}
+		if len(group.TemplateName) == 0 {
+			group.TemplateName = cfg.TemplateName
+		}
+		if len(group.NodeName) == 0 {
+			group.NodeName = cfg.NodeName
+		}
+		if len(group.CloudInitPath) == 0 {
+			group.CloudInitPath = CLOUD_INIT_PATH
+		}
+		if group.MaxSize == 0 {
+			group.MaxSize = maxSize
+		}
+		if group.FullClone == nil {
+			group.FullClone = groups[0].FullClone
+		}
+		if len(group.Storage) == 0 {
+			group.Storage = groups[0].Storage
+		}
+		if group.StorageByNode == nil {
+			group.StorageByNode = groups[0].StorageByNode
+		}
+		if len(group.ResizeDiskName) == 0 {
+			group.ResizeDiskName = groups[0].ResizeDiskName
+		}
+		if len(group.ResizeDiskBy) == 0 {
+			group.ResizeDiskBy = groups[0].ResizeDiskBy
+		}
+		if len(group.HaGroup) == 0 {
+			group.HaGroup = groups[0].HaGroup
+		}
+		if group.FallbackNodes == nil {
+			group.FallbackNodes = groups[0].FallbackNodes
+		}
+		if group.MinSize > group.MaxSize {
+			return nil, errors.New("minSize of group '" + group.Name + "' is larger than its maxSize!")
+		}
+		cloudInit, err := os.ReadFile(group.CloudInitPath)
+		if err != nil {
+			return nil, errors.New("Cloud-Init config for group '" + group.Name + "' not found. Error: " + err.Error())
+		}
+		group.CloudInitConfig = cloudInit
+		groups = append(groups, group)
+	}
+	if err := cfg.validateNodeGroups(groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// Checks the settings every node group needs to provision VMs
+func (c *Config) validateNodeGroups(groups []NodeGroup) error {
+	for _, group := range groups {
+		// The group name and the longest vmid must give a valid hostname
+		if _, err := c.vmName(&group, MAX_VMID); err != nil {
+			return errors.New("namePattern is invalid for node group '" + group.Name + "': " + err.Error())
+		}
+		if err := validateDiskResize(group.ResizeDiskBy); err != nil {
+			return errors.New("Node group '" + group.Name + "': " + err.Error())
+		}
+		if err := ValidateCloudInit(group.CloudInitConfig); err != nil {
+			return errors.New("Cloud-Init template of group '" + group.Name + "' is invalid: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// Splits a comma separated list of proxmox nodes
+func splitNodes(nodes string) []string {
+	var out []string
+	for _, node := range strings.Split(nodes, ",") {
+		if node = strings.TrimSpace(node); len(node) != 0 {
+			out = append(out, node)
+		}
+	}
+	return out
+}
+
+// Returns the node group with the given name or nil
+func (c *Config) Group(name string) *NodeGroup {
+	for i := range c.NodeGroups {
+		if c.NodeGroups[i].Name == name {
+			return &c.NodeGroups[i]
+		}
+	}
+	return nil
+}
+
+// Builds the selector used for IP discovery
+func (c *Config) ipSelector() (*IpSelector, error) {
+	return newIpSelector(c.IpInterfaceRegex, c.IpExcludeInterfaceRegex, c.IpCidrAllowlist, c.IpFamily)
+}
+
+// Builds the IPAM pool or returns nil when ipamCidr is not set
+func (c *Config) ipamPool() (*IpamPool, error) {
+	if len(c.IpamCidr) == 0 {
+		return nil, nil
+	}
+	return newIpamPool(c.IpamCidr, c.IpamGateway, c.IpamReserved, c.IpamNameserver)
+}
+
+// Reads an integer setting that must be at least 1
+func positiveInt(key string, fallback string) (int, error) {
+	value, err := strconv.Atoi(getValueOf(key, fallback))
+	if err != nil {
+		return 0, err
+	}
+	if value < 1 {
+		return 0, errors.New(key + " must be at least 1!")
+	}
+	return value, nil
+}
+
+// Reads a decimal setting that must be above 0
+func positiveFloat(key string, fallback string) (float64, error) {
+	value, err := strconv.ParseFloat(getValueOf(key, fallback), 64)
+	if err != nil {
+		return 0, err
+	}
+	if value <= 0 {
+		return 0, errors.New(key + " must be above 0!")
+	}
+	return value, nil
+}
+
+/*
+tlsConfig builds the TLS settings for
+the proxmox API. Certificates signed by
+the CA bundle are trusted along with
+the system roots.
+*/
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	if c.Insecure {
+		return &tls.Config{InsecureSkipVerify: true}, nil
+	}
+	if len(c.ProxmoxCaBundle) == 0 {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(c.ProxmoxCaBundle)
+	if err != nil {
+		return nil, errors.New("proxmoxCaBundle could not be read: " + err.Error())
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("proxmoxCaBundle does not contain any PEM certificate!")
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// Checks whether the proxmox clients have to be re-created
+func (c *Config) clientChanged(other *Config) bool {
+	return c.Insecure != other.Insecure || c.TaskTimeout != other.TaskTimeout ||
+		c.ProxmoxProxy != other.ProxmoxProxy || c.ProxmoxCaBundle != other.ProxmoxCaBundle ||
+		c.RequestTimeout != other.RequestTimeout || c.TicketRefresh != other.TicketRefresh ||
+		!reflect.DeepEqual(c.Clusters, other.Clusters)
+}
+
+/*
+changedSettings returns the keys of
+all settings that differ between
+the two configs.
+*/
+func (c *Config) changedSettings(other *Config) []string {
+	var changed []string
+	oldVal := reflect.ValueOf(c).Elem()
+	newVal := reflect.ValueOf(other).Elem()
+	for i := 0; i < oldVal.NumField(); i++ {
+		if !reflect.DeepEqual(oldVal.Field(i).Interface(), newVal.Field(i).Interface()) {
+			changed = append(changed, oldVal.Type().Field(i).Tag.Get("key"))
+		}
+	}
+	return changed
+}
+
+/*
+ConfigWatcher watches the mounted
+secrets and cloud-init directories
+and keeps the last valid config
+ready to be applied between
+reconcile cycles.
+*/
+type ConfigWatcher struct {
+	pending atomic.Pointer[Config]
+	reloads int
+}
+
+/*
+WatchConfig starts watching the
+config directories. Kubernetes
+updates mounted volumes by swapping
+a symlink, so the directories are
+watched instead of the files.
+*/
+func WatchConfig() (*ConfigWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{SECRETS_PATH, filepath.Dir(CLOUD_INIT_PATH)} {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+	cw := &ConfigWatcher{}
+	go func() {
+		defer watcher.Close()
+		cw.watch(watcher.Events, watcher.Errors, CONFIG_RELOAD_DEBOUNCE, loadConfig)
+	}()
+	return cw, nil
+}
+
+// How long the config volumes have to be quiet before they are read
+const CONFIG_RELOAD_DEBOUNCE = 2 * time.Second
+
+/*
+watch loads the config with load once
+no event arrived for debounce and
+stores it as pending. Volume updates
+fire a burst of events, so only the
+settled state is read.
+*/
+func (cw *ConfigWatcher) watch(events <-chan fsnotify.Event, errs <-chan error, debounce time.Duration, load func() (*Config, error)) {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+			timer.Reset(debounce)
+		case err, ok := <-errs:
+			if !ok {
+				return
+			}
+			ColorPrint(WARN, "Config watcher error: %v", err)
+		case <-timer.C:
+			cfg, err := load()
+			if err != nil {
+				ColorPrint(WARN, "Ignoring invalid config update: %v", err)
+				continue
+			}
+			cw.pending.Store(cfg)
+		}
+	}
+}
+
+/*
+keepRestartSettings resets the settings
+that are only read at startup to their
+current values and returns the keys
+that were reset.
+*/
+func (c *Config) keepRestartSettings(current *Config) []string {
+	var kept []string
+	if c.MaxConcurrentProvisions != current.MaxConcurrentProvisions {
+		c.MaxConcurrentProvisions = current.MaxConcurrentProvisions
+		kept = append(kept, "maxConcurrentProvisions")
+	}
+	if c.MaxProxmoxRequests != current.MaxProxmoxRequests {
+		c.MaxProxmoxRequests = current.MaxProxmoxRequests
+		kept = append(kept, "maxProxmoxRequests")
+	}
+	if c.MetricsAddress != current.MetricsAddress {
+		c.MetricsAddress = current.MetricsAddress
+		kept = append(kept, "metricsAddress")
+	}
+	return kept
+}
+
+/*
+Apply swaps in the pending config
+if one is waiting and logs which
+settings changed. The current config
+is returned when nothing is pending.
+Settings that are only read at
+startup keep their current value.
+*/
+func (cw *ConfigWatcher) Apply(current *Config) *Config {
+	next := cw.pending.Swap(nil)
+	if next == nil {
+		return current
+	}
+	if kept := next.keepRestartSettings(current); len(kept) != 0 {
+		ColorPrint(WARN, "Ignoring changed settings %v: they require a restart", kept)
+	}
+	changed := current.changedSettings(next)
+	if len(changed) == 0 {
+		return current
+	}
+	cw.reloads++
+	ColorPrint(INFO, "Config reload #%d applied. Changed settings: %v", cw.reloads, changed)
+	return next
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestChangedSettings(t *testing.T) {
+	base := &Config{
+		Debug:           false,
+		ScaleUpStep:     1,
+		NodeName:        "pve",
+		CloudInitConfig: []byte("a"),
+		NodeGroups:      []NodeGroup{{Name: DEFAULT_GROUP}},
+	}
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   []string
+	}{
+		{"unchanged", func(c *Config) {}, nil},
+		{"scalar", func(c *Config) { c.Debug = true }, []string{"debug"}},
+		{"several", func(c *Config) { c.ScaleUpStep = 2; c.NodeName = "pve2" }, []string{"scaleUpStep", "nodeName"}},
+		{"bytes", func(c *Config) { c.CloudInitConfig = []byte("b") }, []string{"cloud-init"}},
+		{"groups", func(c *Config) { c.NodeGroups = []NodeGroup{{Name: "gpu"}} }, []string{"nodeGroups"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := *base
+			tt.change(&next)
+			if got := base.changedSettings(&next); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("changedSettings() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigWatcherDebounce(t *testing.T) {
+	events := make(chan fsnotify.Event)
+	errs := make(chan error)
+	var loads atomic.Int32
+	load := func() (*Config, error) {
+		loads.Add(1)
+		return &Config{ScaleUpStep: int(loads.Load())}, nil
+	}
+	cw := &ConfigWatcher{}
+	done := make(chan struct{})
+	go func() {
+		cw.watch(events, errs, 50*time.Millisecond, load)
+		close(done)
+	}()
+
+	// A burst of events closer together than the debounce loads once
+	for i := 0; i < 5; i++ {
+		events <- fsnotify.Event{Name: "..data"}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := loads.Load(); got != 0 {
+		t.Fatalf("config loaded %d times during the burst", got)
+	}
+	waitFor(t, func() bool { return cw.pending.Load() != nil })
+	time.Sleep(100 * time.Millisecond)
+	if got := loads.Load(); got != 1 {
+		t.Fatalf("config loaded %d times after the burst, want 1", got)
+	}
+
+	close(events)
+	<-done
+}
+
+func TestConfigWatcherKeepsLastValidConfig(t *testing.T) {
+	events := make(chan fsnotify.Event)
+	valid := &Config{ScaleUpStep: 3}
+	var fail atomic.Bool
+	load := func() (*Config, error) {
+		if fail.Load() {
+			return nil, errors.New("memoryLimit not specified in config!")
+		}
+		return valid, nil
+	}
+	cw := &ConfigWatcher{}
+	go cw.watch(events, make(chan error), time.Millisecond, load)
+	defer close(events)
+
+	events <- fsnotify.Event{}
+	waitFor(t, func() bool { return cw.pending.Load() == valid })
+	fail.Store(true)
+	events <- fsnotify.Event{}
+	time.Sleep(20 * time.Millisecond)
+	if cw.pending.Load() != valid {
+		t.Fatal("an invalid update replaced the pending config")
+	}
+}
+
+func TestConfigWatcherApply(t *testing.T) {
+	current := &Config{ScaleUpStep: 1}
+	cw := &ConfigWatcher{}
+	if got := cw.Apply(current); got != current {
+		t.Fatal("Apply without a pending config must keep the current one")
+	}
+
+	cw.pending.Store(&Config{ScaleUpStep: 1})
+	if got := cw.Apply(current); got != current || cw.reloads != 0 {
+		t.Fatal("Apply of an identical config must keep the current one")
+	}
+
+	next := &Config{ScaleUpStep: 2}
+	cw.pending.Store(next)
+	if got := cw.Apply(current); got != next || cw.reloads != 1 {
+		t.Fatalf("Apply() = %+v, reloads = %d", got, cw.reloads)
+	}
+	if cw.pending.Load() != nil {
+		t.Fatal("Apply must consume the pending config")
+	}
+}
+
+func TestConfigWatcherKeepsRestartSettings(t *testing.T) {
+	current := &Config{ScaleUpStep: 1, MaxConcurrentProvisions: 3, MaxProxmoxRequests: 2, MetricsAddress: ":8087"}
+	cw := &ConfigWatcher{}
+
+	cw.pending.Store(&Config{ScaleUpStep: 1, MaxConcurrentProvisions: 5, MaxProxmoxRequests: 4, MetricsAddress: ":9090"})
+	if got := cw.Apply(current); got != current || cw.reloads != 0 {
+		t.Fatal("a reload changing only restart settings must keep the current config")
+	}
+
+	cw.pending.Store(&Config{ScaleUpStep: 2, MaxConcurrentProvisions: 5, MaxProxmoxRequests: 2, MetricsAddress: ":8087"})
+	got := cw.Apply(current)
+	if got.ScaleUpStep != 2 || got.MaxConcurrentProvisions != 3 || cw.reloads != 1 {
+		t.Fatalf("Apply() = %+v, reloads = %d", got, cw.reloads)
+	}
+}
+
+// Polls cond until it holds or five seconds passed
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"github.com/Telmate/proxmox-api-go/proxmox"
+)
+
+const DRY_RUN = "[DRY-RUN] "
+
+/*
+PlanScaleUp logs every action a scale-up
+of count VMs would perform without
+calling any of the proxmox mutation
+APIs, ssh or ansible. Only read-only
+proxmox calls are made to resolve the
+cluster, the template and the next
+vmids. The VMs are planned one after
+the other like Provision does, so each
+one sees the room and vmid taken by the
+ones before it.
+*/
+func PlanScaleUp(clients map[string]*proxmox.Client, cfg *Config, group *NodeGroup, count int, cpuUsage float32, memUsage float32) {
+	ColorPrint(INFO, DRY_RUN+"Scale-up of %d VM(s) triggered at cpu usage: %f and mem usage: %f (limits: %d, %d)", count, cpuUsage, memUsage, cfg.CpuLimit, cfg.MemoryLimit)
+	reservations := NewReservations()
+	vmids := NewVmidAllocator()
+	for i := 0; i < count; i++ {
+		ColorPrint(INFO, DRY_RUN+"Scaling up group '%s': VM %d of %d", group.Name, i+1, count)
+		planVM(clients, cfg, group, reservations, vmids)
+	}
+}
+
+// Logs the actions of ScaleUp for a single VM
+func planVM(clients map[string]*proxmox.Client, cfg *Config, group *NodeGroup, reservations *Reservations, vmids *VmidAllocator) {
+	placement, err := placeVM(clients, cfg, group, reservations)
+	if err != nil {
+		ColorPrint(WARN, DRY_RUN+"No cluster can host the VM and the scale-up would be refused: %v", err)
+		return
+	}
+	client := placement.Client
+	target := group.NodeName
+	group = &placement.Group
+	ColorPrint(INFO, DRY_RUN+"Would place the VM on cluster %s (%s)", placement.Cluster.Name, cfg.ClusterSelection)
+	if group.NodeName != target {
+		ColorPrint(INFO, DRY_RUN+"Node %s is full or replaced by the cluster, the VM would be placed on node %s", target, group.NodeName)
+	}
+
+	sourceVmrs, err := client.GetVmRefsByName(group.TemplateName)
+	if err != nil || len(sourceVmrs) == 0 {
+		ColorPrint(WARN, DRY_RUN+"Template '%s' was not found and CloneVM would fail: %v", group.TemplateName, err)
+		return
+	}
+	sourceVmr := sourceVmrs[0]
+	for _, candVmr := range sourceVmrs {
+		if candVmr.Node() == group.NodeName {
+			sourceVmr = candVmr
+		}
+	}
+	// The vms table is not read in dry-run mode
+	vmid, err := vmids.Allocate(client, func(int) (bool, error) { return false, nil })
+	if err != nil {
+		ColorPrint(WARN, DRY_RUN+"Unable to look up the next vmid: %v", err)
+		return
+	}
+
+	name, err := cfg.vmName(group, vmid)
+	if err != nil {
+		ColorPrint(WARN, DRY_RUN+"namePattern is invalid and the VM could not be named: %v", err)
+		return
+	}
+	cloudInit, err := RenderCloudInit(group.CloudInitConfig, cfg.cloudInitData(group, vmid, name, nil))
+	if err != nil {
+		ColorPrint(WARN, DRY_RUN+"Cloud-Init template is invalid and CloneVM would fail: %v", err)
+		return
+	}
+	config, err := parseQemuConfig(cloudInit)
+	if err != nil {
+		ColorPrint(WARN, DRY_RUN+"Cloud-Init config is invalid and CloneVM would fail: %v", err)
+		return
+	}
+
+	ColorPrint(INFO, DRY_RUN+"Would clone template '%s' (vmid %d on node %s) to vmid %d on node %s for group '%s'", group.TemplateName, sourceVmr.VmId(), sourceVmr.Node(), vmid, group.NodeName, group.Name)
+	ColorPrint(INFO, DRY_RUN+"Would configure VM '%s' with %d cores and %d MB memory", name, config.QemuCores, config.Memory)
+	opts := group.cloneOptions(group.NodeName).forConfig(config)
+	ColorPrint(INFO, DRY_RUN+"Would use full clone: %t, storage: '%s', resize of %s: '%s'", opts.Full, opts.Storage, opts.ResizeDiskName, opts.ResizeDiskBy)
+	if err := checkStorageRoom(client, sourceVmr, group.NodeName, opts); err != nil {
+		ColorPrint(WARN, DRY_RUN+"Storage check failed and CloneVM would fail: %v", err)
+	}
+	meta := cfg.vmMeta(group)
+	ColorPrint(INFO, DRY_RUN+"Would tag VM '%s' with '%s' in pool '%s'", name, meta.Tags, meta.Pool)
+	ColorPrint(INFO, DRY_RUN+"Would save vmid %d in the vms table and start the VM", vmid)
+	if len(group.HaGroup) != 0 {
+		ColorPrint(INFO, DRY_RUN+"Would add VM %d to HA group '%s' with state '%s'", vmid, group.HaGroup, HA_STATE_STARTED)
+	}
+	if len(cfg.AnsibleTag) != 0 && len(cfg.AnsibleRepo) != 0 {
+		ColorPrint(INFO, DRY_RUN+"Would run playbook '%s' from '%s' as user '%s'", cfg.AnsiblePlaybook, cfg.AnsibleRepo, cfg.SshUser)
+	} else {
+		ColorPrint(INFO, DRY_RUN+"Would send the join command over ssh as user '%s'", cfg.SshUser)
+	}
+	ColorPrint(INFO, DRY_RUN+"Would patch node '%s' with labels: %s", name, WORKER_ROLE_PATCH)
+	ColorPrint(INFO, DRY_RUN+"Would set the provider id of node '%s' to '%s'", name, providerID(vmid))
+	ColorPrint(INFO, DRY_RUN+"Would mark VM %d as ready in the vms table", vmid)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+)
+
+// Collects what is logged while fn runs
+func captureLog(t *testing.T, fn func()) string {
+	t.Helper()
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+	fn()
+	return buf.String()
+}
+
+func TestPlanScaleUp(t *testing.T) {
+	backend := newFakeProxmox(t)
+	backend.addVM(testTemplate())
+	cfg := testConfig()
+	clients := map[string]*proxmox.Client{DEFAULT_CLUSTER: backend.client(t)}
+
+	out := captureLog(t, func() {
+		PlanScaleUp(clients, cfg, cfg.Group(DEFAULT_GROUP), 3, 0, 0)
+	})
+	if !strings.Contains(out, "VM 3 of 3") {
+		t.Fatalf("plan does not cover every VM:\n%s", out)
+	}
+	vmids := map[string]bool{}
+	for _, match := range regexp.MustCompile(`to vmid ([0-9]+) on node`).FindAllStringSubmatch(out, -1) {
+		vmids[match[1]] = true
+	}
+	if len(vmids) != 3 {
+		t.Fatalf("plan uses vmids %v, want 3 different ones", vmids)
+	}
+	for vmid := range vmids {
+		if !strings.Contains(out, "provider id of node 'k8s-default-"+vmid+"' to '"+PROVIDER_ID_PREFIX+vmid+"'") {
+			t.Errorf("plan does not set the provider id of VM %s", vmid)
+		}
+	}
+	if writes := backend.count(`^(POST|PUT|DELETE) `); writes != 0 {
+		t.Fatalf("dry-run plan sent %d writes to proxmox", writes)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/clock"
+)
+
+const (
+	AUTOSCALER_NAME = "pve-cluster-autoscaler"
+	NAMESPACE_PATH  = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+	// How long Flush waits for queued events to be written
+	EVENT_FLUSH_TIMEOUT = 10 * time.Second
+)
+
+/*
+Reasons used for the kubernetes
+events emitted by the autoscaler
+*/
+const (
+	EVENT_SCALE_UP_TRIGGERED = "ScaleUpTriggered"
+	EVENT_TRIGGERED_SCALE_UP = "TriggeredScaleUp"
+	EVENT_VM_CLONED          = "VMCloned"
+	EVENT_NODE_JOINED        = "NodeJoined"
+	EVENT_JOIN_FAILED        = "JoinFailed"
+	EVENT_PROVISION_FAILED   = "ProvisioningFailed"
+	EVENT_SCALE_DOWN_STARTED = "ScaleDownStarted"
+	EVENT_INFRA_FULL         = "InfrastructureFull"
+)
+
+/*
+EventRecorder emits kubernetes events
+on the autoscaler deployment and on
+the nodes and pods affected by a
+scaling action. Events are written in
+the background; Flush waits for them
+before the process exits.
+*/
+type EventRecorder struct {
+	broadcaster record.EventBroadcaster
+	recorder    record.EventRecorder
+	correlator  *record.EventCorrelator
+	clientset   kubernetes.Interface
+	deployment  *v1.ObjectReference
+	pending     sync.WaitGroup
+}
+
+/*
+NewEventRecorder creates a recorder
+that writes events to the API server
+for the autoscaler deployment in the
+namespace the pod is running in.
+*/
+func NewEventRecorder(clientset kubernetes.Interface) *EventRecorder {
+	e := &EventRecorder{
+		broadcaster: record.NewBroadcaster(),
+		correlator:  record.NewEventCorrelator(clock.RealClock{}),
+		clientset:   clientset,
+		deployment: &v1.ObjectReference{
+			Kind:       "Deployment",
+			APIVersion: "apps/v1",
+			Namespace:  podNamespace(),
+			Name:       AUTOSCALER_NAME,
+		},
+	}
+	// Without the UID kubectl describe does not list the events
+	deployment, err := clientset.AppsV1().Deployments(e.deployment.Namespace).Get(context.TODO(), AUTOSCALER_NAME, metav1.GetOptions{})
+	if err != nil {
+		ColorPrint(WARN, "Unable to read the autoscaler deployment, its events will not show up in kubectl describe: %v", err)
+	} else {
+		e.deployment.UID = deployment.UID
+	}
+	e.broadcaster.StartEventWatcher(e.write)
+	e.recorder = e.broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: AUTOSCALER_NAME})
+	return e
+}
+
+// Queues an event and counts it until it is written
+func (e *EventRecorder) emit(object runtime.Object, eventType string, reason string, messageFmt string, args ...interface{}) {
+	e.pending.Add(1)
+	e.recorder.Eventf(object, eventType, reason, messageFmt, args...)
+}
+
+/*
+write sends a queued event to the API
+server. Repeated events are merged
+into the existing one by the
+correlator like the default sink does.
+*/
+func (e *EventRecorder) write(event *v1.Event) {
+	defer e.pending.Done()
+	result, err := e.correlator.EventCorrelate(event)
+	if err != nil {
+		ColorPrint(WARN, "Unable to correlate %s event: %v", event.Reason, err)
+	}
+	if result.Skip {
+		return
+	}
+	events := e.clientset.CoreV1().Events(result.Event.Namespace)
+	var written *v1.Event
+	if result.Event.Count > 1 {
+		written, err = events.Patch(context.TODO(), result.Event.Name, types.StrategicMergePatchType, result.Patch, metav1.PatchOptions{})
+	}
+	if result.Event.Count <= 1 || errors.IsNotFound(err) {
+		result.Event.ResourceVersion = ""
+		written, err = events.Create(context.TODO(), result.Event, metav1.CreateOptions{})
+	}
+	if err != nil {
+		ColorPrint(WARN, "Unable to write %s event: %v", event.Reason, err)
+		return
+	}
+	e.correlator.UpdateState(written)
+}
+
+/*
+Flush waits up to EVENT_FLUSH_TIMEOUT
+for the queued events to be written
+and stops the broadcaster. No events
+can be emitted afterwards.
+*/
+func (e *EventRecorder) Flush() {
+	done := make(chan struct{})
+	go func() {
+		e.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(EVENT_FLUSH_TIMEOUT):
+		ColorPrint(WARN, "Not all kubernetes events were written within %s", EVENT_FLUSH_TIMEOUT)
+	}
+	e.broadcaster.Shutdown()
+}
+
+// Returns the namespace of the pod or default
+func podNamespace() string {
+	namespace, err := os.ReadFile(NAMESPACE_PATH)
+	if err != nil || len(namespace) == 0 {
+		return "default"
+	}
+	return strings.TrimSpace(string(namespace))
+}
+
+// Emits an event on the autoscaler deployment
+func (e *EventRecorder) Deployment(eventType string, reason string, messageFmt string, args ...interface{}) {
+	e.emit(e.deployment, eventType, reason, messageFmt, args...)
+}
+
+/*
+Node emits an event on a kubernetes
+node. Nothing is emitted if the node
+does not exist.
+*/
+func (e *EventRecorder) Node(name string, eventType string, reason string, messageFmt string, args ...interface{}) {
+	node, err := e.clientset.CoreV1().Nodes().Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		ColorPrint(WARN, "Unable to emit %s event on node '%s': %v", reason, name, err)
+		return
+	}
+	e.emit(node, eventType, reason, messageFmt, args...)
+}
+
+/*
+PendingPods emits an event on every
+pod that could not be scheduled, as
+these are the pods a scale-up is
+meant to make room for.
+*/
+func (e *EventRecorder) PendingPods(eventType string, reason string, messageFmt string, args ...interface{}) {
+	pods, err := e.clientset.CoreV1().Pods("").List(context.TODO(), metav1.ListOptions{FieldSelector: "status.phase=Pending"})
+	if err != nil {
+		ColorPrint(WARN, "Unable to list pending pods: %v", err)
+		return
+	}
+	for i := range pods.Items {
+		for _, condition := range pods.Items[i].Status.Conditions {
+			if condition.Type == v1.PodScheduled && condition.Status == v1.ConditionFalse && condition.Reason == v1.PodReasonUnschedulable {
+				e.emit(&pods.Items[i], eventType, reason, messageFmt, args...)
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// Returns the events written for objects of kind
+func writtenEvents(t *testing.T, clientset *fake.Clientset, kind string) []v1.Event {
+	t.Helper()
+	list, err := clientset.CoreV1().Events(podNamespace()).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []v1.Event
+	for _, event := range list.Items {
+		if event.InvolvedObject.Kind == kind {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func TestEventRecorderDeployment(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: AUTOSCALER_NAME, Namespace: podNamespace(), UID: types.UID("deployment-uid")},
+	})
+	e := NewEventRecorder(clientset)
+	e.Deployment(v1.EventTypeNormal, EVENT_SCALE_UP_TRIGGERED, "Scaling up group '%s'", DEFAULT_GROUP)
+	e.Deployment(v1.EventTypeNormal, EVENT_SCALE_UP_TRIGGERED, "Scaling up group '%s'", DEFAULT_GROUP)
+	e.Deployment(v1.EventTypeWarning, EVENT_INFRA_FULL, "Scale-up of group '%s' refused", DEFAULT_GROUP)
+	e.Flush()
+
+	events := writtenEvents(t, clientset, "Deployment")
+	if len(events) != 2 {
+		t.Fatalf("%d events written, want the repeated one merged into 2", len(events))
+	}
+	for _, event := range events {
+		if event.InvolvedObject.UID != "deployment-uid" || event.InvolvedObject.Name != AUTOSCALER_NAME || event.Source.Component != AUTOSCALER_NAME {
+			t.Fatalf("event is not bound to the deployment: %+v", event)
+		}
+		switch event.Reason {
+		case EVENT_SCALE_UP_TRIGGERED:
+			if event.Count != 2 || event.Message != "Scaling up group 'default'" {
+				t.Fatalf("repeated event = %d x %q", event.Count, event.Message)
+			}
+		case EVENT_INFRA_FULL:
+			if event.Type != v1.EventTypeWarning {
+				t.Fatalf("%s event has type %s", event.Reason, event.Type)
+			}
+		default:
+			t.Fatalf("unexpected %s event", event.Reason)
+		}
+	}
+}
+
+func TestEventRecorderNodesAndPods(t *testing.T) {
+	unschedulable := v1.PodCondition{Type: v1.PodScheduled, Status: v1.ConditionFalse, Reason: v1.PodReasonUnschedulable}
+	clientset := fake.NewSimpleClientset(
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "k8s-default-120"}},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "waiting", Namespace: "apps"},
+			Status:     v1.PodStatus{Phase: v1.PodPending, Conditions: []v1.PodCondition{unschedulable}},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "pulling", Namespace: "apps"},
+			Status:     v1.PodStatus{Phase: v1.PodPending, Conditions: []v1.PodCondition{{Type: v1.PodScheduled, Status: v1.ConditionTrue}}},
+		},
+	)
+	e := NewEventRecorder(clientset)
+	e.Node("k8s-default-120", v1.EventTypeNormal, EVENT_NODE_JOINED, "VM %d joined the cluster", 120)
+	// Nothing is emitted for a node that does not exist
+	e.Node("k8s-default-121", v1.EventTypeNormal, EVENT_NODE_JOINED, "VM %d joined the cluster", 121)
+	e.PendingPods(v1.EventTypeNormal, EVENT_TRIGGERED_SCALE_UP, "Pod triggered scale-up of group '%s'", DEFAULT_GROUP)
+	e.Flush()
+
+	nodeEvents := writtenEvents(t, clientset, "Node")
+	if len(nodeEvents) != 1 || nodeEvents[0].InvolvedObject.Name != "k8s-default-120" || nodeEvents[0].Reason != EVENT_NODE_JOINED {
+		t.Fatalf("node events = %+v", nodeEvents)
+	}
+	// Pod events are written to the namespace of the pod
+	podEvents, err := clientset.CoreV1().Events("apps").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(podEvents.Items) != 1 || podEvents.Items[0].InvolvedObject.Name != "waiting" || podEvents.Items[0].Reason != EVENT_TRIGGERED_SCALE_UP {
+		t.Fatalf("pod events = %+v", podEvents.Items)
+	}
+}
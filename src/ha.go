@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+)
+
+// Desired state of HA resources created for new VMs
+const HA_STATE_STARTED = "started"
+
+// Returns the API path of the HA resource of a VM
+func haResourcePath(vmid int) string {
+	return fmt.Sprintf("/cluster/ha/resources/vm:%d", vmid)
+}
+
+// Checks whether proxmox answered that the VM is no HA resource
+func haResourceMissing(err error) bool {
+	var apiErr *ApiError
+	return errors.As(err, &apiErr) && strings.Contains(apiErr.Status+" "+apiErr.Body, "no such resource")
+}
+
+/*
+readVmHA returns the state and group of
+the HA resource of a VM. Both are empty
+if the VM is no HA resource. Any other
+failure is returned.
+*/
+func readVmHA(ctx context.Context, client *proxmox.Client, vmid int) (string, string, error) {
+	data, err := apiRequest(ctx, client, http.MethodGet, haResourcePath(vmid), nil)
+	if haResourceMissing(err) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	var resource struct {
+		State string `json:"state"`
+		Group string `json:"group"`
+	}
+	if err := json.Unmarshal(data, &resource); err != nil {
+		return "", "", err
+	}
+	return resource.State, resource.Group, nil
+}
+
+/*
+RegisterVmHA adds a VM as an HA resource
+to the HA group with the desired state
+started, so that proxmox recovers it on
+another host when its node fails. An
+existing resource is moved to the group.
+*/
+func RegisterVmHA(ctx context.Context, client *proxmox.Client, vmid int, group string) error {
+	state, _, err := readVmHA(ctx, client, vmid)
+	if err != nil {
+		return err
+	}
+	params := url.Values{"group": {group}, "state": {HA_STATE_STARTED}}
+	if len(state) == 0 {
+		params.Set("sid", fmt.Sprintf("vm:%d", vmid))
+		_, err = apiRequest(ctx, client, http.MethodPost, "/cluster/ha/resources", params)
+	} else {
+		_, err = apiRequest(ctx, client, http.MethodPut, haResourcePath(vmid), params)
+	}
+	return err
+}
+
+/*
+RemoveVmHA removes the HA resource of a
+VM if it has one. Proxmox would restart
+an HA managed VM that is stopped behind
+its back, so failing to read the
+resource is an error.
+*/
+func RemoveVmHA(ctx context.Context, client *proxmox.Client, vmid int) error {
+	state, _, err := readVmHA(ctx, client, vmid)
+	if err != nil || len(state) == 0 {
+		return err
+	}
+	_, err = apiRequest(ctx, client, http.MethodDelete, haResourcePath(vmid), nil)
+	return err
+}
+
+// Returns the HA group of a VM or "" if it is no HA resource
+func VmHaGroup(client *proxmox.Client, vmid int) string {
+	_, group, err := readVmHA(context.TODO(), client, vmid)
+	if err != nil {
+		ColorPrint(WARN, "Unable to read the HA resource of VM %d: %v", vmid, err)
+	}
+	return group
+}
+
+/*
+haGroupNodes returns the nodes of every
+HA group. Node priorities are dropped.
+*/
+func haGroupNodes(client *proxmox.Client) (map[string][]string, error) {
+	var data map[string]interface{}
+	if err := client.GetJsonRetryable("/cluster/ha/groups", &data, 3); err != nil {
+		return nil, err
+	}
+	groups := map[string][]string{}
+	items, _ := data["data"].([]interface{})
+	for _, item := range items {
+		group, _ := item.(map[string]interface{})
+		name, _ := group["group"].(string)
+		nodes, _ := group["nodes"].(string)
+		for _, node := range strings.Split(nodes, ",") {
+			node, _, _ = strings.Cut(strings.TrimSpace(node), ":")
+			if len(node) != 0 {
+				groups[name] = append(groups[name], node)
+			}
+		}
+		if _, ok := groups[name]; !ok {
+			groups[name] = nil
+		}
+	}
+	return groups, nil
+}
+
+// Checks that the HA group exists and contains the node
+func checkHaGroup(groups map[string][]string, group string, node string) string {
+	nodes, ok := groups[group]
+	if !ok {
+		return fmt.Sprintf("HA group '%s' does not exist", group)
+	}
+	for _, n := range nodes {
+		if n == node {
+			return ""
+		}
+	}
+	return fmt.Sprintf("HA group '%s' does not contain node %s", group, node)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRegisterVmHA(t *testing.T) {
+	backend := newFakeProxmox(t)
+	backend.addVM(fakeVM{VmId: 120, Name: "k8s-default-120", Node: "pve", Status: "running"})
+	client := backend.client(t)
+	ctx := context.Background()
+
+	if err := RegisterVmHA(ctx, client, 120, "k8s"); err != nil {
+		t.Fatal(err)
+	}
+	if resource := backend.ha[120]; resource.State != HA_STATE_STARTED || resource.Group != "k8s" {
+		t.Fatalf("HA resource = %+v", resource)
+	}
+	// An existing resource is moved instead of added twice
+	if err := RegisterVmHA(ctx, client, 120, "k8s-b"); err != nil {
+		t.Fatal(err)
+	}
+	if backend.ha[120].Group != "k8s-b" || backend.count(`^PUT /cluster/ha/resources/vm:120$`) != 1 {
+		t.Fatalf("HA resource = %+v after moving it", backend.ha[120])
+	}
+	if group := VmHaGroup(client, 120); group != "k8s-b" {
+		t.Fatalf("VmHaGroup() = %q", group)
+	}
+
+	backend.failures["GET /cluster/ha/resources/vm:121"] = http.StatusServiceUnavailable
+	backend.addVM(fakeVM{VmId: 121, Name: "k8s-default-121", Node: "pve", Status: "running"})
+	if err := RegisterVmHA(ctx, client, 121, "k8s"); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("RegisterVmHA() with a failing read = %v", err)
+	}
+	if backend.count(`^POST /cluster/ha/resources$`) != 1 {
+		t.Fatal("the VM was registered although its HA resource could not be read")
+	}
+}
+
+func TestRemoveVmHA(t *testing.T) {
+	backend := newFakeProxmox(t)
+	backend.addVM(fakeVM{VmId: 120, Name: "k8s-default-120", Node: "pve", Status: "running"})
+	backend.ha[120] = fakeHA{State: HA_STATE_STARTED, Group: "k8s"}
+	client := backend.client(t)
+	ctx := context.Background()
+
+	if err := RemoveVmHA(ctx, client, 120); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backend.ha[120]; ok {
+		t.Fatal("HA resource was not removed")
+	}
+	// No such resource means there is nothing to remove
+	if err := RemoveVmHA(ctx, client, 120); err != nil {
+		t.Fatalf("RemoveVmHA() of a VM without HA = %v", err)
+	}
+
+	backend.ha[120] = fakeHA{State: HA_STATE_STARTED, Group: "k8s"}
+	backend.failures["GET /cluster/ha/resources/vm:120"] = http.StatusServiceUnavailable
+	if err := RemoveVmHA(ctx, client, 120); err == nil {
+		t.Fatal("RemoveVmHA() ignored a failing read")
+	}
+	if _, err := DestroyVM(ctx, client, 120, 0); err == nil || !strings.Contains(err.Error(), "phase "+DESTROY_PHASE_HA) {
+		t.Fatalf("DestroyVM() = %v, want the HA phase to fail", err)
+	}
+	if backend.count(`^POST /nodes/pve/qemu/120/status/stop$`) != 0 {
+		t.Fatal("a VM still managed by HA was stopped")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+)
+
+const (
+	IP_FAMILY_IPV4 = "ipv4"
+	IP_FAMILY_IPV6 = "ipv6"
+
+	// Default interfaces used for IP discovery
+	DEFAULT_INTERFACE_REGEX         = "^(eth|ens|enp|eno)"
+	DEFAULT_EXCLUDE_INTERFACE_REGEX = "^(lo|docker|cni|flannel|cali|veth|virbr|br-|kube)"
+)
+
+/*
+IpSelector picks the address of a new
+VM from the interfaces reported by the
+qemu guest agent. Interfaces must match
+Interface and must not match Exclude.
+Loopback, link-local and addresses
+outside of Allow are skipped. Family
+is preferred, the other family is only
+used when no preferred address exists.
+*/
+type IpSelector struct {
+	Interface *regexp.Regexp
+	Exclude   *regexp.Regexp
+	Allow     []*net.IPNet
+	Family    string
+}
+
+// Builds a selector from the ip* config keys
+func newIpSelector(interfaceRegex string, excludeRegex string, allowlist string, family string) (*IpSelector, error) {
+	s := &IpSelector{Family: family}
+	var err error
+	if s.Interface, err = regexp.Compile(interfaceRegex); err != nil {
+		return nil, errors.New("ipInterfaceRegex is invalid: " + err.Error())
+	}
+	if s.Exclude, err = regexp.Compile(excludeRegex); err != nil {
+		return nil, errors.New("ipExcludeInterfaceRegex is invalid: " + err.Error())
+	}
+	for _, cidr := range strings.Split(allowlist, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if len(cidr) == 0 {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.New("ipCidrAllowlist is invalid: " + err.Error())
+		}
+		s.Allow = append(s.Allow, ipNet)
+	}
+	if family != IP_FAMILY_IPV4 && family != IP_FAMILY_IPV6 {
+		return nil, errors.New("ipFamily must be either ipv4 or ipv6!")
+	}
+	return s, nil
+}
+
+// Checks a single address against the selector
+func (s *IpSelector) allowed(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return false
+	}
+	if len(s.Allow) == 0 {
+		return true
+	}
+	for _, ipNet := range s.Allow {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the best address of the interfaces
+func (s *IpSelector) Select(interfaces []proxmox.AgentNetworkInterface) (string, error) {
+	var preferred, fallback string
+	for _, interfaceData := range interfaces {
+		if !s.Interface.MatchString(interfaceData.Name) || s.Exclude.MatchString(interfaceData.Name) {
+			continue
+		}
+		for _, ip := range interfaceData.IPAddresses {
+			if !s.allowed(ip) {
+				continue
+			}
+			ColorPrint(INFO, "FOUND IP ADDRESS: %s for INTERFACE: %s", ip.String(), interfaceData.Name)
+			isIpv4 := ip.To4() != nil
+			if isIpv4 == (s.Family == IP_FAMILY_IPV4) {
+				if len(preferred) == 0 {
+					preferred = ip.String()
+				}
+			} else if len(fallback) == 0 {
+				fallback = ip.String()
+			}
+		}
+	}
+	if len(preferred) != 0 {
+		return preferred, nil
+	}
+	if len(fallback) != 0 {
+		return fallback, nil
+	}
+	return "", fmt.Errorf("no usable address on an interface matching '%s'", s.Interface.String())
+}
+
+/*
+staticAddress returns the address set
+in the cloud-init ipconfig0 of the VM,
+e.g. "ip=10.0.0.5/24,gw=10.0.0.1".
+An empty string is returned for dhcp.
+*/
+func staticAddress(config *proxmox.ConfigQemu) string {
+	for _, option := range strings.Split(config.Ipconfig0, ",") {
+		for _, key := range []string{"ip=", "ip6="} {
+			if !strings.HasPrefix(option, key) {
+				continue
+			}
+			ip, _, err := net.ParseCIDR(strings.TrimPrefix(option, key))
+			if err == nil {
+				return ip.String()
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+)
+
+// Builds an interface reported by the guest agent
+func agentInterface(name string, addresses ...string) proxmox.AgentNetworkInterface {
+	iface := proxmox.AgentNetworkInterface{Name: name}
+	for _, address := range addresses {
+		iface.IPAddresses = append(iface.IPAddresses, net.ParseIP(address))
+	}
+	return iface
+}
+
+func TestNewIpSelectorErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		iface     string
+		exclude   string
+		allowlist string
+		family    string
+		err       string
+	}{
+		{"invalid cidr", DEFAULT_INTERFACE_REGEX, DEFAULT_EXCLUDE_INTERFACE_REGEX, "10.0.0.0/8, 192.168.1.0/33", IP_FAMILY_IPV4, "ipCidrAllowlist is invalid"},
+		{"address instead of cidr", DEFAULT_INTERFACE_REGEX, DEFAULT_EXCLUDE_INTERFACE_REGEX, "10.0.0.5", IP_FAMILY_IPV4, "ipCidrAllowlist is invalid"},
+		{"invalid interface regex", "^(eth", DEFAULT_EXCLUDE_INTERFACE_REGEX, "", IP_FAMILY_IPV4, "ipInterfaceRegex is invalid"},
+		{"invalid exclude regex", DEFAULT_INTERFACE_REGEX, "[", "", IP_FAMILY_IPV4, "ipExcludeInterfaceRegex is invalid"},
+		{"unknown family", DEFAULT_INTERFACE_REGEX, DEFAULT_EXCLUDE_INTERFACE_REGEX, "", "ipv5", "ipFamily must be"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newIpSelector(tt.iface, tt.exclude, tt.allowlist, tt.family)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("newIpSelector() = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestIpSelectorSelect(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowlist  string
+		family     string
+		interfaces []proxmox.AgentNetworkInterface
+		want       string
+	}{
+		{
+			"first ipv4 address",
+			"", IP_FAMILY_IPV4,
+			[]proxmox.AgentNetworkInterface{
+				agentInterface("lo", "127.0.0.1", "::1"),
+				agentInterface("eth0", "fe80::1", "fd00::5", "10.0.0.5", "10.0.0.6"),
+			},
+			"10.0.0.5",
+		},
+		{
+			"preferred ipv6",
+			"", IP_FAMILY_IPV6,
+			[]proxmox.AgentNetworkInterface{agentInterface("ens18", "10.0.0.5", "fd00::5")},
+			"fd00::5",
+		},
+		{
+			"other family when nothing is preferred",
+			"", IP_FAMILY_IPV4,
+			[]proxmox.AgentNetworkInterface{agentInterface("ens18", "fe80::1", "fd00::5")},
+			"fd00::5",
+		},
+		{
+			"excluded interfaces",
+			"", IP_FAMILY_IPV4,
+			[]proxmox.AgentNetworkInterface{
+				agentInterface("docker0", "172.17.0.1"),
+				agentInterface("cni0", "10.244.0.1"),
+				agentInterface("enp1s0", "192.168.1.20"),
+			},
+			"192.168.1.20",
+		},
+		{
+			"allowlist",
+			"192.168.1.0/24", IP_FAMILY_IPV4,
+			[]proxmox.AgentNetworkInterface{agentInterface("eth0", "10.0.0.5", "192.168.1.20")},
+			"192.168.1.20",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newIpSelector(DEFAULT_INTERFACE_REGEX, DEFAULT_EXCLUDE_INTERFACE_REGEX, tt.allowlist, tt.family)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.Select(tt.interfaces)
+			if err != nil || got != tt.want {
+				t.Fatalf("Select() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestIpSelectorExhausted(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowlist  string
+		interfaces []proxmox.AgentNetworkInterface
+	}{
+		{"no interfaces", "", nil},
+		{"only loopback and link-local", "", []proxmox.AgentNetworkInterface{
+			agentInterface("lo", "127.0.0.1"),
+			agentInterface("eth0", "fe80::1", "169.254.10.1"),
+		}},
+		{"only excluded interfaces", "", []proxmox.AgentNetworkInterface{
+			agentInterface("flannel.1", "10.244.1.0"),
+			agentInterface("wlan0", "192.168.1.20"),
+		}},
+		{"nothing in the allowlist", "10.10.0.0/16", []proxmox.AgentNetworkInterface{
+			agentInterface("eth0", "10.0.0.5", "fd00::5"),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newIpSelector(DEFAULT_INTERFACE_REGEX, DEFAULT_EXCLUDE_INTERFACE_REGEX, tt.allowlist, IP_FAMILY_IPV4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := s.Select(tt.interfaces); err == nil {
+				t.Fatalf("Select() = %q, want an error", got)
+			}
+		})
+	}
+}
+
+func TestStaticAddress(t *testing.T) {
+	tests := []struct {
+		ipconfig string
+		want     string
+	}{
+		{"ip=10.0.0.5/24,gw=10.0.0.1", "10.0.0.5"},
+		{"gw=10.0.0.1,ip=10.0.0.5/24", "10.0.0.5"},
+		{"ip6=fd00::5/64,gw6=fd00::1", "fd00::5"},
+		{"ip=dhcp", ""},
+		{"ip=dhcp,ip6=auto", ""},
+		{"ip=10.0.0.5", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ipconfig, func(t *testing.T) {
+			if got := staticAddress(&proxmox.ConfigQemu{Ipconfig0: tt.ipconfig}); got != tt.want {
+				t.Fatalf("staticAddress(%q) = %q, want %q", tt.ipconfig, got, tt.want)
+			}
+		})
+	}
+}
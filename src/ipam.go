@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"iter"
+	"net"
+	"strings"
+)
+
+// Returned when every address of the pool is leased
+var ErrPoolExhausted = errors.New("no free address left in ipamCidr")
+
+/*
+IpamPool hands out static IPv4
+addresses from a CIDR for networks
+without DHCP. The network, broadcast
+and gateway addresses and all
+reserved ranges are never leased.
+*/
+type IpamPool struct {
+	Network    *net.IPNet
+	Gateway    net.IP
+	Nameserver string
+	Reserved   [][2]uint32
+}
+
+// Address leased to a VM
+type IpLease struct {
+	Address    string
+	PrefixLen  int
+	Gateway    string
+	Nameserver string
+}
+
+/*
+newIpamPool parses the ipam* config
+keys. reserved is a comma separated
+list of addresses or ranges such as
+"10.0.0.1-10.0.0.20".
+*/
+func newIpamPool(cidr string, gateway string, reserved string, nameserver string) (*IpamPool, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, errors.New("ipamCidr is invalid: " + err.Error())
+	}
+	if network.IP.To4() == nil {
+		return nil, errors.New("ipamCidr must be an IPv4 network!")
+	}
+	pool := &IpamPool{Network: network, Nameserver: nameserver}
+	if len(gateway) != 0 {
+		pool.Gateway = net.ParseIP(gateway).To4()
+		if pool.Gateway == nil || !network.Contains(pool.Gateway) {
+			return nil, errors.New("ipamGateway must be an address in ipamCidr!")
+		}
+	}
+	for _, entry := range strings.Split(reserved, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		bounds := strings.SplitN(entry, "-", 2)
+		if len(bounds) == 1 {
+			bounds = append(bounds, bounds[0])
+		}
+		start := net.ParseIP(strings.TrimSpace(bounds[0])).To4()
+		end := net.ParseIP(strings.TrimSpace(bounds[1])).To4()
+		if start == nil || end == nil || ipToInt(start) > ipToInt(end) {
+			return nil, errors.New("ipamReserved contains an invalid range: " + entry)
+		}
+		pool.Reserved = append(pool.Reserved, [2]uint32{ipToInt(start), ipToInt(end)})
+	}
+	return pool, nil
+}
+
+func ipToInt(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func intToIp(value uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, value)
+	return ip
+}
+
+/*
+Candidates yields the addresses of the
+pool that may be leased in ascending
+order. They are computed one at a time,
+so large networks are never expanded
+into a list.
+*/
+func (p *IpamPool) Candidates() iter.Seq[string] {
+	return func(yield func(string) bool) {
+		ones, bits := p.Network.Mask.Size()
+		first := ipToInt(p.Network.IP)
+		last := first | (1<<uint(bits-ones) - 1)
+		// A /31 or /32 has no address besides network and broadcast
+		if last-first < 2 {
+			return
+		}
+		for value := first + 1; value < last; value++ {
+			if p.reserved(value) {
+				continue
+			}
+			if !yield(intToIp(value).String()) {
+				return
+			}
+		}
+	}
+}
+
+// Tells if an address is the gateway or in a reserved range
+func (p *IpamPool) reserved(value uint32) bool {
+	if p.Gateway != nil && value == ipToInt(p.Gateway) {
+		return true
+	}
+	for _, r := range p.Reserved {
+		if value >= r[0] && value <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Contains tells if an address is one
+the pool may lease, i.e. it is in the
+CIDR and none of the excluded ones
+*/
+func (p *IpamPool) Contains(address string) bool {
+	ip := net.ParseIP(address).To4()
+	if ip == nil || !p.Network.Contains(ip) {
+		return false
+	}
+	ones, bits := p.Network.Mask.Size()
+	first := ipToInt(p.Network.IP)
+	last := first | (1<<uint(bits-ones) - 1)
+	value := ipToInt(ip)
+	return value > first && value < last && !p.reserved(value)
+}
+
+// Returns the first candidate that is not taken
+func (p *IpamPool) Free(taken map[string]bool) (string, error) {
+	for candidate := range p.Candidates() {
+		if !taken[candidate] {
+			return candidate, nil
+		}
+	}
+	return "", ErrPoolExhausted
+}
+
+// Builds the lease for an address of the pool
+func (p *IpamPool) Lease(address string) *IpLease {
+	ones, _ := p.Network.Mask.Size()
+	lease := &IpLease{Address: address, PrefixLen: ones, Nameserver: p.Nameserver}
+	if p.Gateway != nil {
+		lease.Gateway = p.Gateway.String()
+	}
+	return lease
+}
+
+// Formats the lease as a cloud-init ipconfig value
+func (l *IpLease) Ipconfig() string {
+	ipconfig := fmt.Sprintf("ip=%s/%d", l.Address, l.PrefixLen)
+	if len(l.Gateway) != 0 {
+		ipconfig += ",gw=" + l.Gateway
+	}
+	return ipconfig
+}
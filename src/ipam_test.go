@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestIpamCandidates(t *testing.T) {
+	tests := []struct {
+		name     string
+		cidr     string
+		gateway  string
+		reserved string
+		want     []string
+	}{
+		{"network and broadcast", "10.0.0.0/29", "", "", []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"}},
+		{"gateway", "10.0.0.0/29", "10.0.0.1", "", []string{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"}},
+		{"reserved range and address", "10.0.0.0/29", "10.0.0.6", "10.0.0.1-10.0.0.3, 10.0.0.5", []string{"10.0.0.4"}},
+		{"host bits in cidr", "10.0.0.9/30", "", "", []string{"10.0.0.9", "10.0.0.10"}},
+		{"point to point", "10.0.0.0/31", "", "", nil},
+		{"single address", "10.0.0.7/32", "", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := newIpamPool(tt.cidr, tt.gateway, tt.reserved, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := slices.Collect(pool.Candidates()); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Candidates() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIpamPoolErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		cidr     string
+		gateway  string
+		reserved string
+	}{
+		{"invalid cidr", "10.0.0.0/33", "", ""},
+		{"ipv6", "fd00::/64", "", ""},
+		{"gateway outside", "10.0.0.0/24", "10.0.1.1", ""},
+		{"reversed range", "10.0.0.0/24", "", "10.0.0.20-10.0.0.10"},
+		{"invalid address", "10.0.0.0/24", "", "10.0.0.300"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newIpamPool(tt.cidr, tt.gateway, tt.reserved, ""); err == nil {
+				t.Fatal("newIpamPool() accepted an invalid config")
+			}
+		})
+	}
+}
+
+func TestIpamFree(t *testing.T) {
+	pool, err := newIpamPool("10.0.0.0/29", "10.0.0.1", "10.0.0.2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	taken := map[string]bool{"10.0.0.3": true, "10.0.0.5": true}
+	if got, err := pool.Free(taken); err != nil || got != "10.0.0.4" {
+		t.Fatalf("Free() = %s, %v, want 10.0.0.4", got, err)
+	}
+	taken["10.0.0.4"] = true
+	taken["10.0.0.6"] = true
+	if _, err := pool.Free(taken); !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("Free() of an exhausted pool = %v", err)
+	}
+
+	// A /8 is walked lazily and stops at the first free address
+	large, err := newIpamPool("10.0.0.0/8", "", "10.0.0.1-10.255.255.200", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := large.Free(map[string]bool{"10.255.255.201": true}); err != nil || got != "10.255.255.202" {
+		t.Fatalf("Free() = %s, %v, want 10.255.255.202", got, err)
+	}
+}
+
+func TestIpamLease(t *testing.T) {
+	pool, err := newIpamPool("10.0.0.0/24", "10.0.0.1", "", "1.1.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease := pool.Lease("10.0.0.7")
+	if got := lease.Ipconfig(); got != "ip=10.0.0.7/24,gw=10.0.0.1" || lease.Nameserver != "1.1.1.1" {
+		t.Fatalf("Ipconfig() = %s, nameserver %s", got, lease.Nameserver)
+	}
+}
+
+func TestIpamContains(t *testing.T) {
+	pool, err := newIpamPool("10.0.0.0/24", "10.0.0.1", "10.0.0.10-10.0.0.19", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		address string
+		want    bool
+	}{
+		{"10.0.0.2", true},
+		{"10.0.0.254", true},
+		{"10.0.0.0", false},
+		{"10.0.0.255", false},
+		{"10.0.0.1", false},
+		{"10.0.0.15", false},
+		{"10.0.1.5", false},
+		{"192.168.1.20", false},
+		{"fd00::5", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := pool.Contains(tt.address); got != tt.want {
+			t.Errorf("Contains(%q) = %t, want %t", tt.address, got, tt.want)
+		}
+	}
+}
@@ -1,33 +1,196 @@
 package main
 
 import (
-	"crypto/tls"
-	"log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/Telmate/proxmox-api-go/proxmox"
 )
 
 /*
 CreateClient is used to create
-a new client using the provided
-tls config and timeout params and
-the credentials provided to the pod
-via a secret as env vars.
-Proxy is currently not being supported.
+a new client for the cluster using
+the tls, proxy and timeout settings
+of the config and the credentials
+provided to the pod via a secret.
+Authentication is
+handled by a proxmoxAuth transport
+that renews tickets before they
+expire and picks up rotated
+credentials. An error is returned
+when the cluster can not be reached or
+rejects the login.
 */
-func CreateClient(tlsconf *tls.Config, taskTimeout int) (client *proxmox.Client) {
-	c, err := proxmox.NewClient(getValueOf("PM_API_URL", ""), nil, tlsconf, "", taskTimeout)
-	FailError(err)
-	if userRequiresAPIToken(getValueOf("PM_USER", "")) {
-		c.SetAPIToken(getValueOf("PM_USER", ""), getValueOf("PM_PASS", ""))
-		// As test, get the version of the server
-		_, err := c.GetVersion()
+func CreateClient(cfg *Config, cluster ProxmoxCluster) (*proxmox.Client, error) {
+	tlsconf, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		TLSClientConfig:    tlsconf,
+		DisableCompression: true,
+	}
+	if len(cfg.ProxmoxProxy) != 0 {
+		proxyURL, err := url.Parse(cfg.ProxmoxProxy)
 		if err != nil {
-			log.Fatalf("login error: %s", err)
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	apiUrl := cluster.ApiUrl
+	auth := &proxmoxAuth{
+		apiUrl:  apiUrl,
+		cluster: cluster,
+		refresh: time.Duration(cfg.TicketRefresh) * time.Second,
+		timeout: time.Duration(cfg.RequestTimeout) * time.Second,
+		next:    transport,
+	}
+	hclient := &http.Client{Transport: auth, Timeout: auth.timeout}
+	c, err := proxmox.NewClient(apiUrl, hclient, nil, "", cfg.TaskTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := auth.login(); err != nil {
+		return nil, fmt.Errorf("login error: %w", err)
+	}
+	// As test, get the version of the server
+	if _, err := c.GetVersion(); err != nil {
+		return nil, fmt.Errorf("login error: %w", err)
+	}
+	registerApiClient(c, apiUrl, hclient)
+	return c, nil
+}
+
+/*
+proxmoxAuth is an http.RoundTripper
+that adds the proxmox credentials to
+every request. Tickets are renewed
+once they are older than refresh
+and a request that is rejected with
+401 is retried once after reading
+the credentials from disk again.
+*/
+type proxmoxAuth struct {
+	mu       sync.Mutex
+	apiUrl   string
+	cluster  ProxmoxCluster
+	refresh  time.Duration
+	timeout  time.Duration
+	next     http.RoundTripper
+	token    string
+	ticket   string
+	csrf     string
+	loggedIn time.Time
+}
+
+func (a *proxmoxAuth) RoundTrip(req *http.Request) (*http.Response, error) {
+	a.mu.Lock()
+	if len(a.ticket) != 0 && time.Since(a.loggedIn) > a.refresh {
+		ColorPrint(INFO, "Proxmox ticket is older than %s. Logging in again...", a.refresh)
+		if err := a.loginLocked(); err != nil {
+			ColorPrint(WARN, "Unable to renew the proxmox ticket: %v", err)
+		}
+	}
+	authReq := a.authorize(req)
+	a.mu.Unlock()
+
+	resp, err := a.next.RoundTrip(authReq)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || (req.Body != nil && req.GetBody == nil) {
+		return resp, err
+	}
+
+	ColorPrint(WARN, "Proxmox rejected the credentials. Reading them again and logging in...")
+	a.mu.Lock()
+	err = a.loginLocked()
+	if err == nil {
+		authReq = a.authorize(req)
+		if req.GetBody != nil {
+			authReq.Body, err = req.GetBody()
 		}
-	} else {
-		err = c.Login(getValueOf("PM_USER", ""), getValueOf("PM_PASS", ""), getValueOf("PM_OTP", ""))
-		FailError(err)
 	}
-	return c
+	a.mu.Unlock()
+	if err != nil {
+		ColorPrint(WARN, "Unable to log in to proxmox again: %v", err)
+		return resp, nil
+	}
+	resp.Body.Close()
+	return a.next.RoundTrip(authReq)
+}
+
+// Returns a copy of the request carrying the current credentials
+func (a *proxmoxAuth) authorize(req *http.Request) *http.Request {
+	authReq := req.Clone(req.Context())
+	authReq.Header.Del("Authorization")
+	authReq.Header.Del("Cookie")
+	authReq.Header.Del("CSRFPreventionToken")
+	if len(a.token) != 0 {
+		authReq.Header.Set("Authorization", "PVEAPIToken="+a.token)
+	} else if len(a.ticket) != 0 {
+		authReq.Header.Set("Cookie", "PVEAuthCookie="+a.ticket)
+		authReq.Header.Set("CSRFPreventionToken", a.csrf)
+	}
+	return authReq
+}
+
+func (a *proxmoxAuth) login() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.loginLocked()
+}
+
+/*
+loginLocked reads the credentials from
+the secrets and either uses them as an
+API token or requests a new ticket.
+*/
+func (a *proxmoxAuth) loginLocked() error {
+	user := getValueOf(a.cluster.UserKey, "")
+	pass := getValueOf(a.cluster.PassKey, "")
+	if userRequiresAPIToken(user) {
+		a.token, a.ticket, a.csrf = user+"="+pass, "", ""
+		return nil
+	}
+
+	form := url.Values{"username": {user}, "password": {pass}}
+	if otp := getValueOf(a.cluster.OtpKey, ""); len(otp) != 0 {
+		form.Set("otp", otp)
+	}
+	req, err := http.NewRequest(http.MethodPost, a.apiUrl+"/access/ticket", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := (&http.Client{Transport: a.next, Timeout: a.timeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ticket request failed: %s", resp.Status)
+	}
+	var body struct {
+		Data struct {
+			Ticket  string  `json:"ticket"`
+			Csrf    string  `json:"CSRFPreventionToken"`
+			NeedTFA float64 `json:"NeedTFA"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return err
+	}
+	if body.Data.NeedTFA == 1 {
+		return errors.New("missing TFA code")
+	}
+	if len(body.Data.Ticket) == 0 {
+		return errors.New("invalid login response")
+	}
+	a.token, a.ticket, a.csrf = "", body.Data.Ticket, body.Data.Csrf
+	a.loggedIn = time.Now()
+	return nil
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+fakeTicketServer hands out a new ticket
+on every login and only accepts the
+newest one. Setting failLogin makes
+the ticket requests fail.
+*/
+type fakeTicketServer struct {
+	mu        sync.Mutex
+	logins    int
+	ticket    string
+	failLogin bool
+	bodies    []string
+	server    *httptest.Server
+}
+
+func newFakeTicketServer(t *testing.T) *fakeTicketServer {
+	f := &fakeTicketServer{}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeTicketServer) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/access/ticket" {
+		if f.failLogin {
+			http.Error(w, "authentication failure", http.StatusUnauthorized)
+			return
+		}
+		f.logins++
+		f.ticket = fmt.Sprintf("PVE:root@pam:%d", f.logins)
+		fmt.Fprintf(w, `{"data":{"ticket":"%s","CSRFPreventionToken":"csrf-%d"}}`, f.ticket, f.logins)
+		return
+	}
+	if r.Header.Get("Cookie") != "PVEAuthCookie="+f.ticket || r.Header.Get("CSRFPreventionToken") != fmt.Sprintf("csrf-%d", f.logins) {
+		http.Error(w, "invalid ticket", http.StatusUnauthorized)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	f.bodies = append(f.bodies, string(body))
+	fmt.Fprint(w, `{"data":null}`)
+}
+
+// Returns the number of logins and the request bodies seen so far
+func (f *fakeTicketServer) seen() (int, []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.logins, f.bodies
+}
+
+// Expires the current ticket as if it timed out on the server
+func (f *fakeTicketServer) expire() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ticket = "expired"
+}
+
+func newTestAuth(f *fakeTicketServer, refresh time.Duration) (*proxmoxAuth, *http.Client) {
+	auth := &proxmoxAuth{
+		apiUrl:  f.server.URL,
+		refresh: refresh,
+		timeout: 5 * time.Second,
+		next:    http.DefaultTransport,
+	}
+	return auth, &http.Client{Transport: auth}
+}
+
+func postStatus(t *testing.T, client *http.Client, url string, body string) int {
+	t.Helper()
+	resp, err := client.Post(url, "application/x-www-form-urlencoded", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestProxmoxAuthRefresh(t *testing.T) {
+	f := newFakeTicketServer(t)
+	auth, client := newTestAuth(f, 50*time.Millisecond)
+	if err := auth.login(); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := postStatus(t, client, f.server.URL+"/version", ""); status != http.StatusOK {
+		t.Fatalf("status = %d, want 200", status)
+	}
+	if logins, _ := f.seen(); logins != 1 {
+		t.Fatalf("%d logins, want 1", logins)
+	}
+	// The ticket is renewed before it is used once it is older than refresh
+	time.Sleep(60 * time.Millisecond)
+	f.expire()
+	if status := postStatus(t, client, f.server.URL+"/version", ""); status != http.StatusOK {
+		t.Fatalf("status = %d, want 200 with a renewed ticket", status)
+	}
+	if logins, _ := f.seen(); logins != 2 {
+		t.Fatalf("%d logins, want 2", logins)
+	}
+}
+
+func TestProxmoxAuthRelogin(t *testing.T) {
+	f := newFakeTicketServer(t)
+	auth, client := newTestAuth(f, time.Hour)
+	if err := auth.login(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A 401 logs in again and resends the request with its body
+	f.expire()
+	if status := postStatus(t, client, f.server.URL+"/nodes/pve/qemu/120/status/start", "timeout=30"); status != http.StatusOK {
+		t.Fatalf("status = %d, want 200 after logging in again", status)
+	}
+	if logins, bodies := f.seen(); logins != 2 || len(bodies) != 1 || bodies[0] != "timeout=30" {
+		t.Fatalf("logins = %d, bodies = %q", logins, bodies)
+	}
+
+	// The 401 is returned when the new login fails too
+	f.expire()
+	f.mu.Lock()
+	f.failLogin = true
+	f.mu.Unlock()
+	if status := postStatus(t, client, f.server.URL+"/version", ""); status != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401", status)
+	}
+}
+
+func TestProxmoxAuthLoginErrors(t *testing.T) {
+	f := newFakeTicketServer(t)
+	f.failLogin = true
+	auth, _ := newTestAuth(f, time.Hour)
+	if err := auth.login(); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("login() = %v, want the ticket request to fail", err)
+	}
+
+	tfa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data":{"ticket":"PVE:root@pam:TFA","NeedTFA":1}}`)
+	}))
+	defer tfa.Close()
+	auth.apiUrl = tfa.URL
+	if err := auth.login(); err == nil || !strings.Contains(err.Error(), "TFA") {
+		t.Fatalf("login() = %v, want the missing TFA code", err)
+	}
+}
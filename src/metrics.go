@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const METRICS_PREFIX = "pve_autoscaler_"
+
+/*
+CounterVec is a counter per label value
+served in the prometheus text format.
+*/
+type CounterVec struct {
+	Name   string
+	Help   string
+	Label  string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func NewCounterVec(name string, help string, label string) *CounterVec {
+	return &CounterVec{Name: METRICS_PREFIX + name, Help: help, Label: label, values: map[string]float64{}}
+}
+
+func (c *CounterVec) Inc(value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[value]++
+}
+
+// Returns the count of a label value
+func (c *CounterVec) Value(value string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[value]
+}
+
+// Writes the counter in the prometheus text format
+func (c *CounterVec) render(b *strings.Builder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n", c.Name, c.Help)
+	fmt.Fprintf(b, "# TYPE %s counter\n", c.Name)
+	values := make([]string, 0, len(c.values))
+	for value := range c.values {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		fmt.Fprintf(b, "%s{%s=%q} %g\n", c.Name, c.Label, value, c.values[value])
+	}
+}
+
+var (
+	infraFullTotal = NewCounterVec("infrastructure_full_total", "Scale-ups refused because no proxmox node had room for the VM.", "group")
+	counters       = []*CounterVec{infraFullTotal}
+)
+
+// Serves all counters
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	for _, counter := range counters {
+		counter.render(&b)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, b.String())
+}
+
+/*
+ServeMetrics serves /metrics on address
+until ctx is done. An empty address
+turns the endpoint off.
+*/
+func ServeMetrics(ctx context.Context, address string) error {
+	if len(address) == 0 {
+		return nil
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go server.Serve(listener)
+	ColorPrint(INFO, "Serving metrics on %s/metrics", listener.Addr())
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"text/template"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	DEFAULT_NAME_PATTERN = "{{.Prefix}}-{{.Group}}-{{.VmId}}"
+	NAME_SUFFIX_CHARS    = "abcdefghijklmnopqrstuvwxyz0123456789"
+	NAME_ATTEMPTS        = 5
+	// Largest vmid proxmox accepts
+	MAX_VMID = 999999999
+)
+
+/*
+NameData holds the variables of the
+namePattern template. Suffix is a new
+random string on every attempt.
+*/
+type NameData struct {
+	Prefix string
+	Group  string
+	VmId   int
+	Suffix string
+}
+
+func randomSuffix() string {
+	suffix := make([]byte, 5)
+	for i := range suffix {
+		suffix[i] = NAME_SUFFIX_CHARS[rand.Intn(len(NAME_SUFFIX_CHARS))]
+	}
+	return string(suffix)
+}
+
+/*
+renderName renders namePattern for a
+VM and checks that the result can be
+used as a kubernetes node name and
+guest hostname.
+*/
+func renderName(pattern string, data NameData) (string, error) {
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(pattern)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	name := strings.ToLower(out.String())
+	if problems := validation.IsDNS1123Label(name); len(problems) != 0 {
+		return "", fmt.Errorf("'%s' is not a valid hostname: %s", name, strings.Join(problems, ", "))
+	}
+	return name, nil
+}
+
+// Renders the name of a VM from the configured pattern
+func (c *Config) vmName(group *NodeGroup, vmid int) (string, error) {
+	return renderName(c.NamePattern, NameData{Prefix: c.NamePrefix, Group: group.Name, VmId: vmid, Suffix: randomSuffix()})
+}
+
+/*
+newVmName picks the name of a new VM.
+Names that are already used by a
+kubernetes node or a proxmox VM are
+rejected. Patterns with a random
+suffix are retried a few times.
+*/
+func (a *Autoscaler) newVmName(group *NodeGroup, vmid int) (string, error) {
+	for attempt := 0; attempt < NAME_ATTEMPTS; attempt++ {
+		name, err := a.config().vmName(group, vmid)
+		if err != nil {
+			return "", err
+		}
+		_, err = a.clientset.CoreV1().Nodes().Get(context.TODO(), name, metav1.GetOptions{})
+		if err == nil {
+			ColorPrint(WARN, "Name '%s' is already used by a kubernetes node", name)
+			continue
+		}
+		if !apierrors.IsNotFound(err) {
+			return "", err
+		}
+		exists := false
+		for _, client := range a.proxmoxClients() {
+			used, err := VmNameExists(client, name)
+			if err != nil {
+				return "", err
+			}
+			exists = exists || used
+		}
+		if exists {
+			ColorPrint(WARN, "Name '%s' is already used by a proxmox VM", name)
+			continue
+		}
+		return name, nil
+	}
+	return "", errors.New("unable to find an unused name with namePattern " + a.config().NamePattern)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestRenderName(t *testing.T) {
+	data := NameData{Prefix: "k8s", Group: "gpu", VmId: 120, Suffix: "x1y2z"}
+	tests := []struct {
+		name    string
+		pattern string
+		data    NameData
+		want    string
+		wantErr bool
+	}{
+		{"default", DEFAULT_NAME_PATTERN, data, "k8s-gpu-120", false},
+		{"suffix", "{{.Group}}-{{.Suffix}}", data, "gpu-x1y2z", false},
+		{"lowercased", "{{.Prefix}}-{{.Group}}", NameData{Prefix: "K8S", Group: "GPU"}, "k8s-gpu", false},
+		{"underscore in group", DEFAULT_NAME_PATTERN, NameData{Prefix: "k8s", Group: "gpu_nodes", VmId: 120}, "", true},
+		{"too long", "{{.Prefix}}-{{.Group}}-{{.VmId}}", NameData{Prefix: strings.Repeat("k", 60), Group: "gpu", VmId: MAX_VMID}, "", true},
+		{"unknown field", "{{.Cluster}}-{{.VmId}}", data, "", true},
+		{"syntax error", "{{.Prefix", data, "", true},
+		{"empty", "", data, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderName(tt.pattern, tt.data)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Fatalf("renderName() = %q, %v, want %q, error %t", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+/*
+Answers the first taken node lookups
+as found and records the names that
+were looked up
+*/
+func nodesTaken(clientset *fake.Clientset, taken int, names *[]string) {
+	clientset.PrependReactor("get", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		name := action.(k8stesting.GetAction).GetName()
+		*names = append(*names, name)
+		if len(*names) <= taken {
+			return true, &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}, nil
+		}
+		return true, nil, apierrors.NewNotFound(v1.Resource("nodes"), name)
+	})
+}
+
+func TestNewVmName(t *testing.T) {
+	tests := []struct {
+		name       string
+		pattern    string
+		takenNodes int
+		proxmoxVM  string
+		wantErr    bool
+		lookups    int
+	}{
+		{"free", DEFAULT_NAME_PATTERN, 0, "", false, 1},
+		{"suffix retried after node collisions", "{{.Prefix}}-{{.Suffix}}", 3, "", false, 4},
+		{"fixed name used by a node", DEFAULT_NAME_PATTERN, NAME_ATTEMPTS, "", true, NAME_ATTEMPTS},
+		{"fixed name used by a proxmox VM", DEFAULT_NAME_PATTERN, 0, "k8s-default-120", true, NAME_ATTEMPTS},
+		{"suffix exhausted", "{{.Prefix}}-{{.Suffix}}", NAME_ATTEMPTS, "", true, NAME_ATTEMPTS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newFakeProxmox(t)
+			if len(tt.proxmoxVM) != 0 {
+				backend.addVM(fakeVM{VmId: 130, Name: tt.proxmoxVM, Node: "pve"})
+			}
+			var records []VmRecord
+			cfg := testConfig()
+			cfg.NamePattern = tt.pattern
+			a := newTestAutoscaler(cfg, backend.client(t), &records)
+			var names []string
+			nodesTaken(a.clientset.(*fake.Clientset), tt.takenNodes, &names)
+
+			name, err := a.newVmName(cfg.Group(DEFAULT_GROUP), 120)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newVmName() = %q, %v", name, err)
+			}
+			if len(names) != tt.lookups {
+				t.Fatalf("looked up %d node names, want %d: %v", len(names), tt.lookups, names)
+			}
+			if !tt.wantErr && name != names[len(names)-1] {
+				t.Fatalf("newVmName() = %q, want the last free name %q", name, names[len(names)-1])
+			}
+		})
+	}
+}
+
+func TestValidateNodeGroupNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		group   string
+		wantErr bool
+	}{
+		{"valid group", DEFAULT_NAME_PATTERN, "gpu", false},
+		{"underscore", DEFAULT_NAME_PATTERN, "gpu_nodes", true},
+		{"pattern without group", "{{.Prefix}}-{{.VmId}}", "gpu_nodes", false},
+		{"too long with the largest vmid", DEFAULT_NAME_PATTERN, strings.Repeat("g", 50), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.NamePattern = tt.pattern
+			groups := append(cfg.NodeGroups, NodeGroup{Name: tt.group, CloudInitConfig: cfg.CloudInitConfig})
+			err := cfg.validateNodeGroups(groups)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateNodeGroups() = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "'"+tt.group+"'") {
+				t.Fatalf("error %v does not name the group", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/*
+Markers stamped on every cloned VM so
+that autoscaler VMs can be told apart
+in the PVE UI and recovered from
+proxmox when the DB is lost.
+*/
+const (
+	OWNER_TAG         = "pve-cluster-autoscaler"
+	OWNER_DESCRIPTION = "Managed by pve-cluster-autoscaler"
+)
+
+var rxProxmoxTag = regexp.MustCompile(`^[a-z0-9_][a-z0-9_\-+.]*$`)
+
+// Ownership of a managed VM as written to its description
+type VmOwnership struct {
+	Instance string
+	Group    string
+	Created  time.Time
+}
+
+// Proxmox metadata applied to a VM while it is cloned
+type VmMeta struct {
+	Tags        string
+	Description string
+	Pool        string
+}
+
+// Formats the ownership as a VM description
+func (o VmOwnership) Description() string {
+	return fmt.Sprintf("%s\ninstance=%s\ngroup=%s\ncreated=%s\n", OWNER_DESCRIPTION, o.Instance, o.Group, o.Created.UTC().Format(time.RFC3339))
+}
+
+/*
+parseOwnership reads the ownership
+back from a VM description. ok is
+false for VMs that were not created
+by the autoscaler.
+*/
+func parseOwnership(description string) (owner VmOwnership, ok bool) {
+	lines := strings.Split(strings.ReplaceAll(description, "\r", ""), "\n")
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != OWNER_DESCRIPTION {
+		return owner, false
+	}
+	for _, line := range lines[1:] {
+		key, value, found := strings.Cut(strings.TrimSpace(line), "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "instance":
+			owner.Instance = value
+		case "group":
+			owner.Group = value
+		case "created":
+			owner.Created, _ = time.Parse(time.RFC3339, value)
+		}
+	}
+	return owner, true
+}
+
+// Checks the extra tags set in proxmoxTags
+func validateTags(tags string) error {
+	for _, tag := range splitTags(tags) {
+		if !rxProxmoxTag.MatchString(tag) {
+			return errors.New("proxmoxTags contains an invalid tag: " + tag)
+		}
+	}
+	return nil
+}
+
+func splitTags(tags string) []string {
+	var out []string
+	for _, tag := range strings.FieldsFunc(tags, func(r rune) bool { return r == ',' || r == ';' || r == ' ' }) {
+		out = append(out, strings.ToLower(tag))
+	}
+	return out
+}
+
+// Builds the metadata of a new VM in the group
+func (c *Config) vmMeta(group *NodeGroup) VmMeta {
+	tags := append([]string{OWNER_TAG}, splitTags(c.ProxmoxTags)...)
+	owner := VmOwnership{Instance: c.InstanceId, Group: group.Name, Created: time.Now()}
+	return VmMeta{
+		Tags:        strings.Join(tags, ";"),
+		Description: owner.Description(),
+		Pool:        c.ProxmoxPool,
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOwnershipRoundTrip(t *testing.T) {
+	created := time.Date(2024, 5, 17, 10, 30, 0, 0, time.FixedZone("CEST", 2*60*60))
+	owner := VmOwnership{Instance: "prod-a", Group: "gpu", Created: created}
+
+	for name, description := range map[string]string{
+		"as written":       owner.Description(),
+		"crlf line ends":   strings.ReplaceAll(owner.Description(), "\n", "\r\n"),
+		"indented by hand": strings.ReplaceAll(owner.Description(), "\n", "\n  "),
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, ok := parseOwnership(description)
+			if !ok {
+				t.Fatalf("parseOwnership(%q) did not find the marker", description)
+			}
+			if got.Instance != owner.Instance || got.Group != owner.Group || !got.Created.Equal(created) {
+				t.Fatalf("parseOwnership() = %+v, want %+v", got, owner)
+			}
+		})
+	}
+}
+
+func TestParseOwnershipMalformed(t *testing.T) {
+	tests := []struct {
+		name        string
+		description string
+		ok          bool
+		want        VmOwnership
+	}{
+		{"empty", "", false, VmOwnership{}},
+		{"other description", "database server\ninstance=prod-a", false, VmOwnership{}},
+		{"marker not on the first line", "notes\n" + OWNER_DESCRIPTION + "\ninstance=prod-a", false, VmOwnership{}},
+		{"marker only", OWNER_DESCRIPTION, true, VmOwnership{}},
+		{"lines without a value", OWNER_DESCRIPTION + "\ninstance\ngroup=gpu\n\n", true, VmOwnership{Group: "gpu"}},
+		{"unknown keys", OWNER_DESCRIPTION + "\nowner=alice\ninstance=prod-a", true, VmOwnership{Instance: "prod-a"}},
+		{"invalid created", OWNER_DESCRIPTION + "\ngroup=default\ncreated=yesterday", true, VmOwnership{Group: "default"}},
+		{"value containing =", OWNER_DESCRIPTION + "\ninstance=a=b", true, VmOwnership{Instance: "a=b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseOwnership(tt.description)
+			if ok != tt.ok || got != tt.want {
+				t.Fatalf("parseOwnership() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestProxmoxTags(t *testing.T) {
+	tests := []struct {
+		tags  string
+		split []string
+		valid bool
+	}{
+		{"", nil, true},
+		{"k8s", []string{"k8s"}, true},
+		{"K8s,Worker; zone-a  rack_1", []string{"k8s", "worker", "zone-a", "rack_1"}, true},
+		{"v1.2+build", []string{"v1.2+build"}, true},
+		{"-leading-dash", []string{"-leading-dash"}, false},
+		{"ok,b@d", []string{"ok", "b@d"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tags, func(t *testing.T) {
+			if got := splitTags(tt.tags); !reflect.DeepEqual(got, tt.split) {
+				t.Fatalf("splitTags(%q) = %q, want %q", tt.tags, got, tt.split)
+			}
+			if err := validateTags(tt.tags); (err == nil) != tt.valid {
+				t.Fatalf("validateTags(%q) = %v", tt.tags, err)
+			}
+		})
+	}
+}
+
+func TestVmMeta(t *testing.T) {
+	cfg := testConfig()
+	cfg.ProxmoxTags = "Zone-A,k8s"
+	cfg.ProxmoxPool = "autoscaled"
+	meta := cfg.vmMeta(cfg.Group("gpu"))
+	if meta.Tags != OWNER_TAG+";zone-a;k8s" || meta.Pool != "autoscaled" {
+		t.Fatalf("vmMeta() = %+v", meta)
+	}
+	owner, ok := parseOwnership(meta.Description)
+	if !ok || owner.Instance != cfg.InstanceId || owner.Group != "gpu" || time.Since(owner.Created) > time.Minute {
+		t.Fatalf("ownership of %q = %+v, %v", meta.Description, owner, ok)
+	}
+}
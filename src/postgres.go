@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"log"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/Telmate/proxmox-api-go/proxmox"
@@ -49,6 +52,25 @@ func testDBConnection(dbName string, user string, password string) string {
 	return connStr
 }
 
+// Pools that stay open for lookups made in a loop, by connection string
+var sharedDBs sync.Map
+
+// Returns the shared pool of the database
+func sharedDB(connStr string) (*sql.DB, error) {
+	if db, ok := sharedDBs.Load(connStr); ok {
+		return db.(*sql.DB), nil
+	}
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, err
+	}
+	if existing, loaded := sharedDBs.LoadOrStore(connStr, db); loaded {
+		db.Close()
+		return existing.(*sql.DB), nil
+	}
+	return db, nil
+}
+
 // Creates the vms table in postgres
 func createTable(db *sql.DB) error {
 	sqlStatement := `CREATE TABLE IF NOT EXISTS vms (vmid serial PRIMARY KEY,
@@ -57,6 +79,16 @@ func createTable(db *sql.DB) error {
 					vmType VARCHAR(50),
 					memory INTEGER NOT NULL,
 					cores INTEGER NOT NULL
+					);
+					ALTER TABLE vms ADD COLUMN IF NOT EXISTS name VARCHAR(100) NOT NULL DEFAULT '';
+					ALTER TABLE vms ADD COLUMN IF NOT EXISTS nodegroup VARCHAR(50) NOT NULL DEFAULT 'default';
+					ALTER TABLE vms ADD COLUMN IF NOT EXISTS state VARCHAR(20) NOT NULL DEFAULT 'provisioning';
+					ALTER TABLE vms ADD COLUMN IF NOT EXISTS reason TEXT NOT NULL DEFAULT '';
+					ALTER TABLE vms ADD COLUMN IF NOT EXISTS ip VARCHAR(50) NOT NULL DEFAULT '';
+					ALTER TABLE vms ADD COLUMN IF NOT EXISTS ha_group VARCHAR(50) NOT NULL DEFAULT '';
+					ALTER TABLE vms ADD COLUMN IF NOT EXISTS cluster VARCHAR(50) NOT NULL DEFAULT 'default';
+					CREATE TABLE IF NOT EXISTS leases (address VARCHAR(50) PRIMARY KEY,
+					vmid INTEGER NOT NULL
 					);`
 
 	_, err := db.Exec(sqlStatement)
@@ -64,25 +96,59 @@ func createTable(db *sql.DB) error {
 }
 
 /*
-InsertVmInfo handles insertion of data and retry
-mechanism for postgres db
+VmRecord is a row of the vms table
+describing a VM managed by the
+autoscaler
 */
-func InsertVmInfo(connStr string, vmr *proxmox.VmRef, config *proxmox.ConfigQemu) {
-	db, err := sql.Open("postgres", connStr)
-	FailError(err)
-	defer db.Close()
-	err = insertDBRecord(db, vmr, config)
-	// Keep retying to insert row in case of any errors
-	for err != nil {
-		err = insertDBRecord(db, vmr, config)
-		time.Sleep(10 * time.Second)
+type VmRecord struct {
+	VmId    int
+	Node    string
+	Pool    string
+	VmType  string
+	Memory  int
+	Cores   int
+	Name    string
+	Group   string
+	State   string
+	Reason  string
+	IP      string
+	HaGroup string
+	Cluster string
+}
+
+/*
+VM states saved in the vms table
+*/
+// How long a cloned VM is retried to be saved in the db
+const DB_INSERT_TIMEOUT = 2 * time.Minute
+
+const (
+	VM_PROVISIONING = "provisioning"
+	VM_READY        = "ready"
+	VM_FAILED       = "failed"
+)
+
+/*
+InsertVmInfo saves the record of a
+cloned VM, retrying failed inserts
+until DB_INSERT_TIMEOUT expires
+*/
+func InsertVmInfo(ctx context.Context, connStr string, vmr *proxmox.VmRef, config *proxmox.ConfigQemu, group string, cluster string) error {
+	db, err := sharedDB(connStr)
+	if err != nil {
+		return fmt.Errorf("unable to save VM %d in the db: %w", vmr.VmId(), err)
 	}
+	ctx, cancel := context.WithTimeout(ctx, DB_INSERT_TIMEOUT)
+	defer cancel()
+	return retryWithBackoff(ctx, "Saving VM info in the db", func() error {
+		return insertDBRecord(db, vmr, config, group, cluster)
+	})
 }
 
 // Inserts records into postgres
-func insertDBRecord(db *sql.DB, vmr *proxmox.VmRef, config *proxmox.ConfigQemu) error {
-	sqlStatement := `INSERT INTO vms (vmid, node, pool, vmtype, memory, cores) VALUES ($1, $2, $3, $4, $5, $6) RETURNING vmid;`
-	_, err := db.Exec(sqlStatement, vmr.VmId(), vmr.Node(), config.Pool, vmr.GetVmType(), config.Memory, config.QemuCores)
+func insertDBRecord(db *sql.DB, vmr *proxmox.VmRef, config *proxmox.ConfigQemu, group string, cluster string) error {
+	sqlStatement := `INSERT INTO vms (vmid, node, pool, vmtype, memory, cores, name, nodegroup, state, cluster) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING vmid;`
+	_, err := db.Exec(sqlStatement, vmr.VmId(), vmr.Node(), config.Pool, vmr.GetVmType(), config.Memory, config.QemuCores, config.Name, group, VM_PROVISIONING, cluster)
 	if err != nil {
 		ColorPrint(INFO, "Ran into error while insering data into db: %v", err)
 		ColorPrint(WARN, "Attempting to re-create vms table if it does not exists.")
@@ -92,6 +158,7 @@ func insertDBRecord(db *sql.DB, vmr *proxmox.VmRef, config *proxmox.ConfigQemu)
 		} else {
 			ColorPrint(WARN, "'vms' table was re-created in DB!")
 			ColorPrint(WARN, "Application will not have access to older VM records if the table was deleted manually!")
+			ColorPrint(WARN, "Run './app rebuild-state' to recover them from proxmox.")
 		}
 	} else {
 		ColorPrint(INFO, "Saved config of cloned VM in DB. Id: %d", vmr.VmId())
@@ -99,3 +166,244 @@ func insertDBRecord(db *sql.DB, vmr *proxmox.VmRef, config *proxmox.ConfigQemu)
 	}
 	return err
 }
+
+// Updates the state column of a VM record
+func UpdateVmState(connStr string, vmid int, state string) error {
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec(`UPDATE vms SET state = $1 WHERE vmid = $2;`, state, vmid)
+	return err
+}
+
+// Saves the address of a VM
+func UpdateVmAddress(connStr string, vmid int, ip string) error {
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec(`UPDATE vms SET ip = $1 WHERE vmid = $2;`, ip, vmid)
+	return err
+}
+
+// Saves the HA group a VM is registered in, "" if none
+func UpdateVmHaGroup(connStr string, vmid int, haGroup string) error {
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec(`UPDATE vms SET ha_group = $1 WHERE vmid = $2;`, haGroup, vmid)
+	return err
+}
+
+// Inserts or replaces a full VM record
+func UpsertVmInfo(connStr string, r VmRecord) error {
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec(`INSERT INTO vms (vmid, node, pool, vmtype, memory, cores, name, nodegroup, state, reason, ip, ha_group, cluster)
+					VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+					ON CONFLICT (vmid) DO UPDATE SET node = $2, pool = $3, vmtype = $4, memory = $5, cores = $6,
+					name = $7, nodegroup = $8, state = $9, reason = $10, ip = $11, ha_group = $12, cluster = $13;`,
+		r.VmId, r.Node, r.Pool, r.VmType, r.Memory, r.Cores, r.Name, r.Group, r.State, r.Reason, r.IP, r.HaGroup, r.Cluster)
+	return err
+}
+
+// Marks a VM as failed and saves the reason
+func MarkVmFailed(connStr string, vmid int, reason string) error {
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec(`UPDATE vms SET state = $1, reason = $2 WHERE vmid = $3;`, VM_FAILED, reason, vmid)
+	return err
+}
+
+// Deletes the record of a VM from postgres
+func DeleteVmInfo(connStr string, vmid int) error {
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec(`DELETE FROM vms WHERE vmid = $1;`, vmid)
+	return err
+}
+
+/*
+AllocateLease leases the first free
+address of the pool to the vmid. The
+taken addresses are read once and the
+primary key on address keeps parallel
+provisions from getting the same one.
+*/
+func AllocateLease(connStr string, pool *IpamPool, vmid int) (*IpLease, error) {
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var address string
+	err = db.QueryRow(`SELECT address FROM leases WHERE vmid = $1;`, vmid).Scan(&address)
+	if err == nil {
+		return pool.Lease(address), nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+	taken, err := leasedAddresses(db)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		candidate, err := pool.Free(taken)
+		if err != nil {
+			return nil, err
+		}
+		res, err := db.Exec(`INSERT INTO leases (address, vmid) VALUES ($1, $2) ON CONFLICT DO NOTHING;`, candidate, vmid)
+		if err != nil {
+			return nil, err
+		}
+		if rows, _ := res.RowsAffected(); rows == 1 {
+			return pool.Lease(candidate), nil
+		}
+		// Leased by a parallel provision in the meantime
+		taken[candidate] = true
+	}
+}
+
+// Reads the set of leased addresses
+func leasedAddresses(db *sql.DB) (map[string]bool, error) {
+	rows, err := db.Query(`SELECT address FROM leases;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	taken := map[string]bool{}
+	for rows.Next() {
+		var address string
+		if err := rows.Scan(&address); err != nil {
+			return nil, err
+		}
+		taken[address] = true
+	}
+	return taken, rows.Err()
+}
+
+/*
+RestoreLease saves an existing lease,
+e.g. when rebuilding the state. An
+address that is already leased keeps
+its lease and the vmid holding it is
+returned.
+*/
+func RestoreLease(connStr string, address string, vmid int) (int, error) {
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	res, err := db.Exec(`INSERT INTO leases (address, vmid) VALUES ($1, $2) ON CONFLICT DO NOTHING;`, address, vmid)
+	if err != nil {
+		return 0, err
+	}
+	if rows, _ := res.RowsAffected(); rows == 1 {
+		return vmid, nil
+	}
+	var owner int
+	err = db.QueryRow(`SELECT vmid FROM leases WHERE address = $1;`, address).Scan(&owner)
+	return owner, err
+}
+
+// Releases the address leased to a VM
+func ReleaseLease(connStr string, vmid int) error {
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec(`DELETE FROM leases WHERE vmid = $1;`, vmid)
+	return err
+}
+
+// Columns of a VmRecord in the order scanVmRecord reads them
+const VM_COLUMNS = `vmid, node, COALESCE(pool, ''), COALESCE(vmtype, ''), memory, cores, name, nodegroup, state, reason, ip, ha_group, cluster`
+
+// Reads a row selected with VM_COLUMNS
+func scanVmRecord(row interface{ Scan(...any) error }) (VmRecord, error) {
+	var r VmRecord
+	err := row.Scan(&r.VmId, &r.Node, &r.Pool, &r.VmType, &r.Memory, &r.Cores, &r.Name, &r.Group, &r.State, &r.Reason, &r.IP, &r.HaGroup, &r.Cluster)
+	return r, err
+}
+
+// Lists the records of all managed VMs ordered by vmid
+func ListVmInfo(connStr string) ([]VmRecord, error) {
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query(`SELECT ` + VM_COLUMNS + ` FROM vms ORDER BY vmid;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []VmRecord
+	for rows.Next() {
+		r, err := scanVmRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// Reads the single record matching the condition, nil if there is none
+func findVmInfo(connStr string, condition string, arg any) (*VmRecord, error) {
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	r, err := scanVmRecord(db.QueryRow(`SELECT `+VM_COLUMNS+` FROM vms WHERE `+condition+` ORDER BY vmid LIMIT 1;`, arg))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Checks whether a managed VM with the vmid is recorded
+func VmidRecorded(connStr string, vmid int) (bool, error) {
+	db, err := sharedDB(connStr)
+	if err != nil {
+		return false, err
+	}
+	var found int
+	err = db.QueryRow(`SELECT 1 FROM vms WHERE vmid = $1;`, vmid).Scan(&found)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Finds the record of a managed VM using its vmid
+func GetVmInfo(connStr string, vmid int) (*VmRecord, error) {
+	return findVmInfo(connStr, "vmid = $1", vmid)
+}
+
+// Finds the record of a managed VM using its name
+func GetVmInfoByName(connStr string, name string) (*VmRecord, error) {
+	return findVmInfo(connStr, "name = $1", name)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+)
+
+// vmids Allocate checks before it gives up
+const VMID_SCAN_LIMIT = 1000
+
+/*
+VmidAllocator hands out vmids to
+concurrent clones. /cluster/nextid
+keeps returning the same id until the
+clone exists, so ids are reserved here
+until the caller releases them.
+*/
+type VmidAllocator struct {
+	mu       sync.Mutex
+	reserved map[int]bool
+}
+
+func NewVmidAllocator() *VmidAllocator {
+	return &VmidAllocator{reserved: map[int]bool{}}
+}
+
+/*
+Reserves the next free vmid that is not
+taken. taken keeps vmids unique across
+proxmox clusters and its errors are
+returned at once. The lock is only held
+while a vmid is reserved, not during
+the proxmox and DB lookups.
+*/
+func (v *VmidAllocator) Allocate(client *proxmox.Client, taken func(vmid int) (bool, error)) (int, error) {
+	vmid, err := client.GetNextID(0)
+	for attempt := 0; err == nil; attempt++ {
+		if attempt == VMID_SCAN_LIMIT {
+			return 0, fmt.Errorf("no free vmid found after checking %d vmids", VMID_SCAN_LIMIT)
+		}
+		if v.reserve(vmid) {
+			used, err := taken(vmid)
+			if err != nil {
+				v.Release(vmid)
+				return 0, fmt.Errorf("unable to check whether vmid %d is taken: %w", vmid, err)
+			}
+			if !used {
+				return vmid, nil
+			}
+			v.Release(vmid)
+		}
+		vmid, err = client.GetNextID(vmid + 1)
+	}
+	return 0, err
+}
+
+// Reserves a vmid unless it is reserved already
+func (v *VmidAllocator) reserve(vmid int) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.reserved[vmid] {
+		return false
+	}
+	v.reserved[vmid] = true
+	return true
+}
+
+// Releases a vmid once the clone exists or has failed
+func (v *VmidAllocator) Release(vmid int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.reserved, vmid)
+}
+
+/*
+acquireProxmox blocks until one of the
+maxProxmoxRequests slots is free. It is
+used around the heavy proxmox calls so
+parallel provisioning does not flood
+the API.
+*/
+func (a *Autoscaler) acquireProxmox() {
+	a.proxmoxSlots <- struct{}{}
+}
+
+func (a *Autoscaler) releaseProxmox() {
+	<-a.proxmoxSlots
+}
+
+// Starts a VM while holding a proxmox slot
+func (a *Autoscaler) startVM(ctx context.Context, client *proxmox.Client, vmid int) (string, error) {
+	a.acquireProxmox()
+	defer a.releaseProxmox()
+	return StartVM(ctx, client, vmid)
+}
+
+// Checks whether a managed VM on any cluster already uses the vmid
+func (a *Autoscaler) vmidTaken(vmid int) (bool, error) {
+	return VmidRecorded(a.connStr, vmid)
+}
+
+/*
+destroyVM destroys a VM while holding
+a proxmox slot and releases its IPAM
+lease once the VM is gone. A graceful
+destroy shuts the guest down first.
+*/
+func (a *Autoscaler) destroyVM(ctx context.Context, client *proxmox.Client, vmid int, graceful bool) (string, error) {
+	shutdownTimeout := 0
+	if graceful {
+		shutdownTimeout = a.config().VmShutdownTimeout
+	}
+	a.acquireProxmox()
+	res, err := DestroyVM(ctx, client, vmid, shutdownTimeout)
+	a.releaseProxmox()
+	if err != nil {
+		return res, err
+	}
+	a.releaseLease(vmid)
+	return res, nil
+}
+
+// Releases the IPAM lease of a VM
+func (a *Autoscaler) releaseLease(vmid int) {
+	if err := ReleaseLease(a.connStr, vmid); err != nil {
+		ColorPrint(WARN, "Unable to release the IP lease of VM %d: %v", vmid, err)
+	}
+}
+
+// Outcome of provisioning a single VM
+type ProvisionResult struct {
+	Group    string
+	Duration time.Duration
+	Err      error
+}
+
+/*
+Provision creates count VMs in the group
+using a pool of maxConcurrentProvisions
+workers. Every VM gets its own context
+derived from ctx. Once ctx is done no
+new VMs are started. The results of
+all VMs are logged and returned.
+*/
+func (a *Autoscaler) Provision(ctx context.Context, group *NodeGroup, count int) []ProvisionResult {
+	workers := a.config().MaxConcurrentProvisions
+	if count < workers {
+		workers = count
+	}
+	ColorPrint(INFO, "Provisioning %d VM(s) for group '%s' using %d worker(s)", count, group.Name, workers)
+
+	jobs := make(chan int, count)
+	for i := 0; i < count; i++ {
+		jobs <- i
+	}
+	close(jobs)
+
+	results := make([]ProvisionResult, count)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				// Do not start new VMs once shutdown was requested
+				if ctx.Err() != nil {
+					results[i] = ProvisionResult{Group: group.Name, Err: fmt.Errorf("not started: %w", ctx.Err())}
+					continue
+				}
+				vmCtx, cancel := a.vmContext(ctx)
+				start := time.Now()
+				err := a.ScaleUp(vmCtx, group)
+				cancel()
+				results[i] = ProvisionResult{Group: group.Name, Duration: time.Since(start), Err: err}
+			}
+		}()
+	}
+	wg.Wait()
+
+	failed := 0
+	for i, result := range results {
+		if result.Err != nil {
+			failed++
+			ColorPrint(WARN, "VM %d of %d for group '%s' failed after %s: %v", i+1, count, group.Name, result.Duration.Round(time.Second), result.Err)
+		}
+	}
+	ColorPrint(INFO, "Provisioned %d/%d VM(s) for group '%s'", count-failed, count, group.Name)
+	return results
+}
+
+// Returns an error summarizing failed results or nil
+func provisionError(results []ProvisionResult) error {
+	failed := 0
+	var last error
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			last = result.Err
+		}
+	}
+	if failed == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %d VM(s) failed to provision, last error: %v", failed, len(results), last)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestVmidAllocator(t *testing.T) {
+	backend := newFakeProxmox(t)
+	client := backend.client(t)
+	vmids := NewVmidAllocator()
+
+	// 100 is recorded for a VM of another cluster
+	checked := []int{}
+	vmid, err := vmids.Allocate(client, func(vmid int) (bool, error) {
+		checked = append(checked, vmid)
+		return vmid == 100, nil
+	})
+	if err != nil || vmid != 101 {
+		t.Fatalf("Allocate() = %d, %v, want 101", vmid, err)
+	}
+	// 101 is still reserved, so the next caller skips it without a lookup
+	checked = nil
+	next, err := vmids.Allocate(client, func(vmid int) (bool, error) {
+		checked = append(checked, vmid)
+		return vmid == 100, nil
+	})
+	if err != nil || next != 102 {
+		t.Fatalf("second Allocate() = %d, %v, want 102", next, err)
+	}
+	if len(checked) != 2 || checked[0] != 100 || checked[1] != 102 {
+		t.Fatalf("checked vmids %v, want [100 102]", checked)
+	}
+}
+
+func TestVmidAllocatorLookupError(t *testing.T) {
+	backend := newFakeProxmox(t)
+	client := backend.client(t)
+	vmids := NewVmidAllocator()
+	down := errors.New("connection refused")
+
+	calls := 0
+	_, err := vmids.Allocate(client, func(vmid int) (bool, error) {
+		calls++
+		return false, down
+	})
+	if !errors.Is(err, down) || !strings.Contains(err.Error(), "vmid 100") {
+		t.Fatalf("Allocate() = %v, want the lookup error", err)
+	}
+	if calls != 1 {
+		t.Fatalf("taken was called %d times after it failed", calls)
+	}
+	if len(vmids.reserved) != 0 {
+		t.Fatalf("reserved = %v after a failed allocation", vmids.reserved)
+	}
+
+	calls = 0
+	_, err = vmids.Allocate(client, func(vmid int) (bool, error) {
+		calls++
+		return true, nil
+	})
+	if err == nil || calls != VMID_SCAN_LIMIT {
+		t.Fatalf("Allocate() with every vmid taken = %v after %d lookups", err, calls)
+	}
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/Telmate/proxmox-api-go/proxmox"
@@ -11,27 +16,60 @@ import (
 
 /*
 
-Creates a new clone of the provided template and
-configures it according to cloudInitConfig
+Creates a new clone of the provided template with
+the given vmid and configures it according to
+cloudInitConfig. The name is used for the VM
+and the guest hostname. The tags, description and
+pool of meta are applied and opts decide how the
+template is cloned. A static lease overrides
+the ipconfig0 and nameserver of the config. The VM
+may already exist when an error is returned
+after the clone started. A clone task that is
+still running once ctx is done gets stopped.
 */
-func CloneVM(client *proxmox.Client, template string, cloudInitConfig []byte, node string, runAnsiblePlaybook bool) (*proxmox.ConfigQemu, *proxmox.VmRef) {
-	config, err := proxmox.NewConfigQemuFromJson(bytes.NewReader(cloudInitConfig))
+func CloneVM(ctx context.Context, client *proxmox.Client, template string, cloudInitConfig []byte, node string, vmid int, name string, meta VmMeta, opts CloneOptions, lease *IpLease, runAnsiblePlaybook bool) (*proxmox.ConfigQemu, *proxmox.VmRef, error) {
+	config, err := parseQemuConfig(cloudInitConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	config.Name = name
+	config.Tags = meta.Tags
+	config.Description = meta.Description
+	config.Pool = meta.Pool
+	fullClone := 0
+	if opts.Full {
+		fullClone = 1
+	}
+	config.FullClone = &fullClone
+	if len(opts.Storage) != 0 {
+		config.Storage = opts.Storage
+		if disk0, ok := config.QemuDisks[0]; ok {
+			disk0["storage"] = opts.Storage
+		}
+	}
 	if runAnsiblePlaybook {
 		// Enable qemu agent - needed for ansible
 		config.Agent = 1
 	}
+	if lease != nil {
+		config.Ipconfig0 = lease.Ipconfig()
+		if len(lease.Nameserver) != 0 {
+			config.Nameserver = lease.Nameserver
+		}
+	}
 
-	FailError(err)
 	log.Println("Looking for template: " + template)
 	sourceVmrs, err := client.GetVmRefsByName(template)
-	FailError(err)
+	if err != nil {
+		return nil, nil, err
+	}
 	if sourceVmrs == nil {
-		log.Fatal("Can't find template")
+		return nil, nil, errors.New("Can't find template " + template)
 	}
-	vmid, err := client.GetNextID(0)
-	FailError(err)
 	vmr := proxmox.NewVmRef(vmid)
 	vmr.SetNode(node)
+	// Clone straight into the pool
+	vmr.SetPool(meta.Pool)
 	log.Print("Creating node: ")
 	log.Println(vmr)
 	// prefer source Vm located on same node
@@ -42,77 +80,326 @@ func CloneVM(client *proxmox.Client, template string, cloudInitConfig []byte, no
 		}
 	}
 
-	FailError(config.CloneVm(sourceVmr, vmr, client))
-	FailError(config.UpdateConfig(vmr, client))
-	err = proxmox.WaitForShutdown(vmr, client)
-	FailError(err)
+	if err = checkStorageRoom(client, sourceVmr, node, opts.forConfig(config)); err != nil {
+		return config, vmr, err
+	}
+	vmr.SetVmType("qemu")
+	upid, err := StartTask(ctx, client, http.MethodPost, fmt.Sprintf("/nodes/%s/qemu/%d/clone", sourceVmr.Node(), sourceVmr.VmId()), cloneParams(config, vmr))
+	if err != nil {
+		return config, vmr, err
+	}
+	task, err := AwaitTask(ctx, client, upid)
+	if err != nil {
+		if task != nil && task.Running {
+			ColorPrint(WARN, "Stopping clone task %s", upid.Raw)
+			if stopErr := StopTask(client, upid); stopErr != nil {
+				ColorPrint(WARN, "Unable to stop clone task %s: %v", upid.Raw, stopErr)
+			}
+		}
+		return config, vmr, err
+	}
+	if err = ctx.Err(); err != nil {
+		return config, vmr, err
+	}
+	if err = config.UpdateConfig(vmr, client); err != nil {
+		return config, vmr, err
+	}
+	if len(opts.ResizeDiskBy) != 0 {
+		log.Printf("Resizing disk %s by %s", opts.ResizeDiskName, opts.ResizeDiskBy)
+		if _, err = client.ResizeQemuDiskRaw(vmr, opts.ResizeDiskName, opts.ResizeDiskBy); err != nil {
+			return config, vmr, err
+		}
+	}
+	if err = WaitForPowerOff(ctx, vmr, client); err != nil {
+		return config, vmr, err
+	}
 	log.Println("Completed cloning process")
-	return config, vmr
+	return config, vmr, nil
 }
 
 /*
-Destroy function stops and
-deletes am existing VM
-using its vmid
+cloneParams builds the clone request
+the same way config.CloneVm does.
 */
-func DestroyVM(client *proxmox.Client, vmid int) (string, error) {
-	vmr := proxmox.NewVmRef(vmid)
-	jbody, err := client.StopVm(vmr)
-	if err != nil {
-		return jbody, err
+func cloneParams(config *proxmox.ConfigQemu, vmr *proxmox.VmRef) url.Values {
+	full := "1"
+	if config.FullClone != nil {
+		full = strconv.Itoa(*config.FullClone)
 	}
-	ColorPrint(INFO, jbody)
-	jbody, err = client.DeleteVm(vmr)
-	ColorPrint(INFO, jbody)
-	return jbody, err
+	params := url.Values{
+		"newid":  {strconv.Itoa(vmr.VmId())},
+		"target": {vmr.Node()},
+		"name":   {config.Name},
+		"full":   {full},
+	}
+	if len(vmr.Pool()) != 0 {
+		params.Set("pool", vmr.Pool())
+	}
+	if storage := cloneStorage(config); full == "1" && len(storage) != 0 {
+		params.Set("storage", storage)
+	}
+	return params
 }
 
-//Starts an existing VM using its vmid
-func StartVM(client *proxmox.Client, vmid int) (string, error) {
+/*
+Phases of destroying a VM
+*/
+const (
+	DESTROY_PHASE_HA       = "RemoveHA"
+	DESTROY_PHASE_SHUTDOWN = "Shutdown"
+	DESTROY_PHASE_STOP     = "Stop"
+	DESTROY_PHASE_DELETE   = "Delete"
+	DESTROY_PHASE_JOBS     = "VerifyJobs"
+	// Seconds a shutdown task may run past its own timeout
+	SHUTDOWN_GRACE = 30
+)
+
+/*
+DestroyVM removes a VM from HA, shuts
+it down through ACPI or the guest agent
+and falls back to a hard stop when it is
+still running after shutdownTimeout
+seconds. A shutdownTimeout of 0 skips
+the graceful shutdown. The VM is then
+deleted with its disks and purged from
+replication and backup jobs. A VM that
+is already gone counts as destroyed.
+*/
+func DestroyVM(ctx context.Context, client *proxmox.Client, vmid int, shutdownTimeout int) (string, error) {
+	exists, err := VmExists(client, vmid)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		ColorPrint(INFO, "VM %d is already gone", vmid)
+		return "", nil
+	}
 	vmr := proxmox.NewVmRef(vmid)
-	jbody, err := client.StartVm(vmr)
+	if err := client.CheckVmRef(vmr); err != nil {
+		return "", err
+	}
+
+	destroyPhase(vmid, DESTROY_PHASE_HA)
+	if err := RemoveVmHA(ctx, client, vmid); err != nil {
+		return "", fmt.Errorf("phase %s failed: %w", DESTROY_PHASE_HA, err)
+	}
+
+	running, err := vmRunning(client, vmr)
 	if err != nil {
 		return "", err
 	}
-	return jbody, err
+	if running && shutdownTimeout > 0 {
+		destroyPhase(vmid, DESTROY_PHASE_SHUTDOWN)
+		if _, err := ShutdownVM(ctx, client, vmr, shutdownTimeout); err != nil {
+			ColorPrint(WARN, "VM %d did not shut down gracefully, stopping it: %v", vmid, err)
+			if running, err = vmRunning(client, vmr); err != nil {
+				return "", err
+			}
+		} else {
+			running = false
+		}
+	}
+	if running {
+		destroyPhase(vmid, DESTROY_PHASE_STOP)
+		task, err := RunTask(ctx, client, http.MethodPost, vmPath(vmr)+"/status/stop", nil)
+		if err != nil {
+			return taskSummary(task), fmt.Errorf("phase %s failed: %w", DESTROY_PHASE_STOP, err)
+		}
+	}
+
+	destroyPhase(vmid, DESTROY_PHASE_DELETE)
+	// purge also drops the vmid from replication, backup and HA configs
+	task, err := RunTask(ctx, client, http.MethodDelete, vmPath(vmr), url.Values{
+		"purge":                      {"1"},
+		"destroy-unreferenced-disks": {"1"},
+	})
+	if err != nil {
+		return taskSummary(task), fmt.Errorf("phase %s failed: %w", DESTROY_PHASE_DELETE, err)
+	}
+
+	destroyPhase(vmid, DESTROY_PHASE_JOBS)
+	if jobs, err := vmJobs(client, vmid); err != nil {
+		ColorPrint(WARN, "Unable to check the jobs of VM %d: %v", vmid, err)
+	} else if len(jobs) != 0 {
+		ColorPrint(WARN, "VM %d is still referenced by jobs that need to be cleaned up manually: %s", vmid, strings.Join(jobs, ", "))
+	}
+	return taskSummary(task), nil
+}
+
+// Returns the API path of a VM
+func vmPath(vmr *proxmox.VmRef) string {
+	return fmt.Sprintf("/nodes/%s/qemu/%d", vmr.Node(), vmr.VmId())
+}
+
+// Reports the phase a VM deletion is in
+func destroyPhase(vmid int, phase string) {
+	ColorPrint(INFO, "Destroying VM %d: phase %s", vmid, phase)
+}
+
+// Checks whether a VM is running
+func vmRunning(client *proxmox.Client, vmr *proxmox.VmRef) (bool, error) {
+	vmState, err := client.GetVmState(vmr)
+	if err != nil {
+		return false, err
+	}
+	return vmState["status"] == "running", nil
+}
+
+/*
+ShutdownVM asks the guest to shut down
+through ACPI or the guest agent. The
+shutdown task itself stops the VM when
+it is still running after timeout
+seconds, so the config lock is released
+once it ends. A task that outlives its
+own timeout is stopped.
+*/
+func ShutdownVM(ctx context.Context, client *proxmox.Client, vmr *proxmox.VmRef, timeout int) (*TaskStatus, error) {
+	upid, err := StartTask(ctx, client, http.MethodPost, vmPath(vmr)+"/status/shutdown", url.Values{
+		"timeout":   {strconv.Itoa(timeout)},
+		"forceStop": {"1"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout+SHUTDOWN_GRACE)*time.Second)
+	defer cancel()
+	task, err := AwaitTask(ctx, client, upid)
+	if err != nil && task != nil && task.Running {
+		ColorPrint(WARN, "Stopping shutdown task %s", upid.Raw)
+		if stopErr := StopTask(client, upid); stopErr != nil {
+			ColorPrint(WARN, "Unable to stop shutdown task %s: %v", upid.Raw, stopErr)
+		}
+	}
+	return task, err
+}
+
+/*
+vmJobs lists the replication and backup
+jobs that still reference a VM
+*/
+func vmJobs(client *proxmox.Client, vmid int) ([]string, error) {
+	var jobs []string
+	var data map[string]interface{}
+	if err := client.GetJsonRetryable("/cluster/replication", &data, 3); err != nil {
+		return nil, err
+	}
+	items, _ := data["data"].([]interface{})
+	for _, item := range items {
+		job, _ := item.(map[string]interface{})
+		if guest, ok := job["guest"].(float64); ok && int(guest) == vmid {
+			jobs = append(jobs, fmt.Sprintf("replication %v", job["id"]))
+		}
+	}
+
+	data = nil
+	if err := client.GetJsonRetryable("/cluster/backup", &data, 3); err != nil {
+		return nil, err
+	}
+	items, _ = data["data"].([]interface{})
+	for _, item := range items {
+		job, _ := item.(map[string]interface{})
+		ids, _ := job["vmid"].(string)
+		for _, id := range strings.Split(ids, ",") {
+			if strings.TrimSpace(id) == strconv.Itoa(vmid) {
+				jobs = append(jobs, fmt.Sprintf("backup %v", job["id"]))
+			}
+		}
+	}
+	return jobs, nil
+}
+
+// Checks whether a VM with the vmid exists in the cluster
+func VmExists(client *proxmox.Client, vmid int) (bool, error) {
+	list, err := client.GetVmList()
+	if err != nil {
+		return false, err
+	}
+	vms, _ := list["data"].([]interface{})
+	for _, vm := range vms {
+		if id, ok := vm.(map[string]interface{})["vmid"].(float64); ok && int(id) == vmid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Checks whether a VM with the name exists in the cluster
+func VmNameExists(client *proxmox.Client, name string) (bool, error) {
+	list, err := client.GetVmList()
+	if err != nil {
+		return false, err
+	}
+	vms, _ := list["data"].([]interface{})
+	for _, vm := range vms {
+		if vmName, ok := vm.(map[string]interface{})["name"].(string); ok && vmName == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//Starts an existing VM using its vmid
+func StartVM(ctx context.Context, client *proxmox.Client, vmid int) (string, error) {
+	return vmStatusTask(ctx, client, vmid, "start")
 }
 
 //Stops an existing VM using its vmid
-func StopVM(client *proxmox.Client, vmid int) string {
+func StopVM(ctx context.Context, client *proxmox.Client, vmid int) (string, error) {
+	return vmStatusTask(ctx, client, vmid, "stop")
+}
+
+// Runs a status change task of a VM, e.g. start
+func vmStatusTask(ctx context.Context, client *proxmox.Client, vmid int, action string) (string, error) {
 	vmr := proxmox.NewVmRef(vmid)
-	jbody, err := client.StopVm(vmr)
-	FailError(err)
-	return jbody
+	if err := client.CheckVmRef(vmr); err != nil {
+		return "", err
+	}
+	task, err := RunTask(ctx, client, http.MethodPost, vmPath(vmr)+"/status/"+action, nil)
+	return taskSummary(task), err
 }
 
-// Wait for VM to power on
-func WaitForPowerOn(vmr *proxmox.VmRef, client *proxmox.Client) (err error) {
-	for ii := 0; ii < 100; ii++ {
+/*
+WaitForPowerOn polls the VM state
+until it is running or ctx is done
+*/
+func WaitForPowerOn(ctx context.Context, vmr *proxmox.VmRef, client *proxmox.Client) error {
+	return retryWithBackoff(ctx, fmt.Sprintf("Waiting for VM %d to power on", vmr.VmId()), func() error {
 		vmState, err := client.GetVmState(vmr)
 		if err != nil {
-			log.Print("Wait error:")
-			log.Println(err)
-		} else if vmState["status"] == "running" {
-			return nil
+			return err
 		}
-		ColorPrint(INFO, "Waiting for VM to power on.")
-		time.Sleep(5 * time.Second)
-	}
-	return errors.New("VM did not start within wait time")
+		if vmState["status"] != "running" {
+			return fmt.Errorf("VM is %v", vmState["status"])
+		}
+		return nil
+	})
 }
 
-// Wait for ping success from Qemu Agent
-func WaitForQemuAgent(vmr *proxmox.VmRef, client *proxmox.Client) (err error) {
-	for ii := 0; ii < 100; ii++ {
-		_, err := client.QemuAgentPing(vmr)
+/*
+WaitForPowerOff polls the VM state
+until it is stopped or ctx is done
+*/
+func WaitForPowerOff(ctx context.Context, vmr *proxmox.VmRef, client *proxmox.Client) error {
+	return retryWithBackoff(ctx, fmt.Sprintf("Waiting for VM %d to power off", vmr.VmId()), func() error {
+		vmState, err := client.GetVmState(vmr)
 		if err != nil {
-			log.Print("Wait error:")
-			log.Println(err)
-		} else {
-			return nil
+			return err
 		}
-		ColorPrint(INFO, "Waiting for qemu agent to start for VM %d.", vmr.VmId())
-		time.Sleep(5 * time.Second)
-	}
-	return errors.New("qemu agent did not start within wait time")
+		if vmState["status"] != "stopped" {
+			return fmt.Errorf("VM is %v", vmState["status"])
+		}
+		return nil
+	})
+}
+
+/*
+WaitForQemuAgent pings the qemu agent
+until it answers or ctx is done
+*/
+func WaitForQemuAgent(ctx context.Context, vmr *proxmox.VmRef, client *proxmox.Client) error {
+	return retryWithBackoff(ctx, fmt.Sprintf("Waiting for qemu agent of VM %d", vmr.VmId()), func() error {
+		_, err := client.QemuAgentPing(vmr)
+		return err
+	})
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+)
+
+const TEST_CLONE_CONFIG = `{"name": "k8s", "memory": 2048, "cores": 2, "sockets": 1, "disk": {"0": {"type": "scsi", "size": "10G", "storage": "fast-lvm"}}}`
+
+func TestCloneVM(t *testing.T) {
+	backend := newFakeProxmox(t)
+	backend.addVM(fakeVM{VmId: 9000, Name: "template", Node: "pve", Template: true})
+	client := backend.client(t)
+
+	config, vmr, err := CloneVM(context.Background(), client, "template", []byte(TEST_CLONE_CONFIG), "pve", 120, "k8s-default-120", VmMeta{Pool: "k8s"}, CloneOptions{Full: true}, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vmr.VmId() != 120 || config.Name != "k8s-default-120" || config.Agent != 1 {
+		t.Fatalf("CloneVM() = %+v, %v", config, vmr)
+	}
+	form := backend.form("POST /nodes/pve/qemu/9000/clone")
+	if form.Get("newid") != "120" || form.Get("pool") != "k8s" || form.Get("full") != "1" || form.Get("storage") != "fast-lvm" {
+		t.Fatalf("clone request = %v", form)
+	}
+	if backend.count(`^POST /nodes/pve/qemu/120/config$`) != 1 {
+		t.Fatal("the config of the clone was not updated")
+	}
+}
+
+func TestCloneVMDeadline(t *testing.T) {
+	backend := newFakeProxmox(t)
+	backend.addVM(fakeVM{VmId: 9000, Name: "template", Node: "pve", Template: true})
+	backend.holdTasks = true
+	client := backend.client(t)
+
+	err := runPhase(context.Background(), PHASE_CLONING, 1, func(ctx context.Context) error {
+		_, _, err := CloneVM(ctx, client, "template", []byte(TEST_CLOUD_INIT), "pve", 120, "k8s-default-120", VmMeta{}, CloneOptions{}, nil, false)
+		return err
+	})
+	if err == nil || !strings.Contains(err.Error(), "did not finish within 1s") {
+		t.Fatalf("runPhase() = %v", err)
+	}
+	var taskErr *TaskError
+	if !errors.As(err, &taskErr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error %v is not a TaskError with an expired deadline", err)
+	}
+	if stops := backend.count(`^DELETE /nodes/pve/tasks/UPID:`); stops != 1 {
+		t.Fatalf("clone task was stopped %d times, want 1", stops)
+	}
+	if task := backend.task(taskErr.Task.UPID.Raw); task == nil || task.Running {
+		t.Fatalf("clone task is still running: %+v", task)
+	}
+	if backend.count(`^POST /nodes/pve/qemu/120/config$`) != 0 {
+		t.Fatal("the config was updated after the deadline")
+	}
+}
+
+func TestStartTaskErrors(t *testing.T) {
+	backend := newFakeProxmox(t)
+	client := backend.client(t)
+	ctx := context.Background()
+
+	if _, err := StartTask(ctx, client, http.MethodPost, "/nodes/pve/qemu/9000/clone", nil); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Fatalf("StartTask() of a missing template = %v", err)
+	}
+	if _, err := StartTask(ctx, client, http.MethodGet, "/version", nil); err == nil {
+		t.Fatal("StartTask() accepted an answer without a UPID")
+	}
+	unregistered := *client
+	if _, err := StartTask(ctx, &unregistered, http.MethodGet, "/version", nil); err == nil {
+		t.Fatal("StartTask() used an unregistered client")
+	}
+}
+
+func TestDestroyVMShutdown(t *testing.T) {
+	backend := newFakeProxmox(t)
+	backend.addVM(fakeVM{VmId: 120, Name: "k8s-default-120", Node: "pve", Status: "running"})
+	client := backend.client(t)
+
+	if _, err := DestroyVM(context.Background(), client, 120, 45); err != nil {
+		t.Fatal(err)
+	}
+	form := backend.form("POST /nodes/pve/qemu/120/status/shutdown")
+	if form.Get("timeout") != "45" || form.Get("forceStop") != "1" {
+		t.Fatalf("shutdown request = %v", form)
+	}
+	if backend.count(`^POST /nodes/pve/qemu/120/status/stop$`) != 0 {
+		t.Fatal("VM was stopped after a clean shutdown")
+	}
+	if _, ok := backend.vms[120]; ok {
+		t.Fatal("VM was not deleted")
+	}
+}
+
+func TestShutdownVMDeadline(t *testing.T) {
+	backend := newFakeProxmox(t)
+	backend.addVM(fakeVM{VmId: 120, Name: "k8s-default-120", Node: "pve", Status: "running"})
+	backend.holdTasks = true
+	client := backend.client(t)
+	vmr := proxmox.NewVmRef(120)
+	if err := client.CheckVmRef(vmr); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	task, err := ShutdownVM(ctx, client, vmr, 45)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ShutdownVM() = %v", err)
+	}
+	if backend.count(`^DELETE /nodes/pve/tasks/UPID:`) != 1 {
+		t.Fatal("the shutdown task was not stopped")
+	}
+	if task := backend.task(task.UPID.Raw); task == nil || task.Running {
+		t.Fatalf("shutdown task is still running: %+v", task)
+	}
+}
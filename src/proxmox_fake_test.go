@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+)
+
+// A VM known to the fake proxmox backend
+type fakeVM struct {
+	VmId     int
+	Name     string
+	Node     string
+	Status   string
+	Template bool
+	MaxMem   float64
+	MaxCpu   float64
+	Config   map[string]interface{}
+}
+
+// Memory and cores of a fake proxmox node
+type fakeNode struct {
+	MemTotal float64
+	MemUsed  float64
+	Cpus     float64
+}
+
+// A task started on the fake backend
+type fakeTask struct {
+	UPID       string
+	Running    bool
+	ExitStatus string
+	Log        []string
+}
+
+/*
+fakeProxmox is an in-process PVE API
+serving the endpoints the autoscaler
+uses. A real proxmox.Client talks to it
+over HTTP, so the code under test is
+unchanged. Requests are recorded and
+gate can hold back the VM list to keep
+callers in flight. Tasks finish at once
+unless holdTasks is set, with OK or the
+exit status failTasks holds for their
+type. failures answers "METHOD path"
+requests with the given status.
+*/
+type fakeProxmox struct {
+	mu        sync.Mutex
+	server    *httptest.Server
+	vms       map[int]*fakeVM
+	nodes     map[string]fakeNode
+	storages  map[string]float64
+	tasks     map[string]*fakeTask
+	forms     map[string]url.Values
+	requests  []string
+	gate      chan struct{}
+	holdTasks bool
+	failTasks map[string]string
+	ha        map[int]fakeHA
+	failures  map[string]int
+}
+
+// The HA resource of a fake VM
+type fakeHA struct {
+	State string
+	Group string
+}
+
+var (
+	rxFakeNodeStatus    = regexp.MustCompile(`^/nodes/([^/]+)/status$`)
+	rxFakeVmConfig      = regexp.MustCompile(`^/nodes/([^/]+)/qemu/([0-9]+)/config$`)
+	rxFakeVmStatus      = regexp.MustCompile(`^/nodes/([^/]+)/qemu/([0-9]+)/status/current$`)
+	rxFakeStorageStatus = regexp.MustCompile(`^/nodes/([^/]+)/storage/([^/]+)/status$`)
+	rxFakeClone         = regexp.MustCompile(`^/nodes/([^/]+)/qemu/([0-9]+)/clone$`)
+	rxFakeTask          = regexp.MustCompile(`^/nodes/([^/]+)/tasks/([^/]+)$`)
+	rxFakeTaskStatus    = regexp.MustCompile(`^/nodes/([^/]+)/tasks/([^/]+)/status$`)
+	rxFakeTaskLog       = regexp.MustCompile(`^/nodes/([^/]+)/tasks/([^/]+)/log$`)
+	rxFakeVm            = regexp.MustCompile(`^/nodes/([^/]+)/qemu/([0-9]+)$`)
+	rxFakeVmAction      = regexp.MustCompile(`^/nodes/([^/]+)/qemu/([0-9]+)/status/(start|stop|shutdown)$`)
+	rxFakeHaResource    = regexp.MustCompile(`^/cluster/ha/resources/(?:vm:)?([0-9]+)$`)
+)
+
+func newFakeProxmox(t *testing.T) *fakeProxmox {
+	f := &fakeProxmox{
+		vms:      map[int]*fakeVM{},
+		nodes:    map[string]fakeNode{"pve": {MemTotal: 64 << 30, MemUsed: 8 << 30, Cpus: 16}},
+		storages: map[string]float64{"local-lvm": 500 << 30},
+		tasks:    map[string]*fakeTask{},
+		forms:    map[string]url.Values{},
+		ha:       map[int]fakeHA{},
+		failures: map[string]int{},
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// Returns a proxmox client connected to the fake backend
+func (f *fakeProxmox) client(t *testing.T) *proxmox.Client {
+	client, err := proxmox.NewClient(f.server.URL+"/api2/json", f.server.Client(), nil, "", 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerApiClient(client, f.server.URL+"/api2/json", f.server.Client())
+	return client
+}
+
+func (f *fakeProxmox) addVM(vm fakeVM) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if vm.Status == "" {
+		vm.Status = "stopped"
+	}
+	if vm.Config == nil {
+		vm.Config = map[string]interface{}{}
+	}
+	vm.Config["name"] = vm.Name
+	f.vms[vm.VmId] = &vm
+}
+
+// Returns the form of the last request to "METHOD path"
+func (f *fakeProxmox) form(request string) url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.forms[request]
+}
+
+// Returns the task with the UPID
+func (f *fakeProxmox) task(upid string) *fakeTask {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tasks[upid]
+}
+
+// Counts the requests whose "METHOD path" matches pattern
+func (f *fakeProxmox) count(pattern string) int {
+	rx := regexp.MustCompile(pattern)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	count := 0
+	for _, request := range f.requests {
+		if rx.MatchString(request) {
+			count++
+		}
+	}
+	return count
+}
+
+func (f *fakeProxmox) handle(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path[len("/api2/json"):]
+	r.ParseForm()
+	f.mu.Lock()
+	f.requests = append(f.requests, r.Method+" "+path)
+	f.forms[r.Method+" "+path] = r.Form
+	gate := f.gate
+	f.mu.Unlock()
+
+	if r.Method == http.MethodGet && path == "/cluster/resources" && gate != nil {
+		<-gate
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var data interface{}
+	status := http.StatusOK
+	if code, ok := f.failures[r.Method+" "+path]; ok {
+		http.Error(w, fmt.Sprintf("%d fake proxmox: injected failure", code), code)
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && path == "/access/ticket":
+		data = map[string]interface{}{"ticket": "PVE:root@pam:FAKE", "CSRFPreventionToken": "FAKE"}
+	case r.Method == http.MethodPost && rxFakeClone.MatchString(path):
+		match := rxFakeClone.FindStringSubmatch(path)
+		newid, _ := strconv.Atoi(r.PostForm.Get("newid"))
+		if f.vm(match[2]) == nil || newid == 0 || f.vms[newid] != nil {
+			status = http.StatusInternalServerError
+			break
+		}
+		f.vms[newid] = &fakeVM{VmId: newid, Name: r.PostForm.Get("name"), Node: r.PostForm.Get("target"), Status: "stopped", Config: map[string]interface{}{"name": r.PostForm.Get("name")}}
+		data = f.startTask(match[1], "qmclone", match[2])
+	case r.Method == http.MethodPost && rxFakeVmConfig.MatchString(path):
+		vm := f.vm(rxFakeVmConfig.FindStringSubmatch(path)[2])
+		if vm == nil {
+			status = http.StatusInternalServerError
+			break
+		}
+		for key := range r.PostForm {
+			vm.Config[key] = r.PostForm.Get(key)
+		}
+	case r.Method == http.MethodPost && rxFakeVmAction.MatchString(path):
+		match := rxFakeVmAction.FindStringSubmatch(path)
+		vm := f.vm(match[2])
+		if vm == nil {
+			status = http.StatusInternalServerError
+			break
+		}
+		data = f.startTask(match[1], "qm"+match[3], match[2])
+		// Held and failed tasks have not changed the VM
+		if _, failed := f.failTasks["qm"+match[3]]; !f.holdTasks && !failed {
+			vm.Status = map[string]string{"start": "running", "stop": "stopped", "shutdown": "stopped"}[match[3]]
+		}
+	case r.Method == http.MethodDelete && rxFakeVm.MatchString(path):
+		match := rxFakeVm.FindStringSubmatch(path)
+		vm := f.vm(match[2])
+		if vm == nil {
+			status = http.StatusInternalServerError
+			break
+		}
+		data = f.startTask(match[1], "qmdestroy", match[2])
+		if _, failed := f.failTasks["qmdestroy"]; !f.holdTasks && !failed {
+			delete(f.vms, vm.VmId)
+		}
+	case r.Method == http.MethodPost && path == "/cluster/ha/resources":
+		vmid, _ := strconv.Atoi(strings.TrimPrefix(r.PostForm.Get("sid"), "vm:"))
+		if _, exists := f.ha[vmid]; exists || f.vms[vmid] == nil {
+			status = http.StatusInternalServerError
+			break
+		}
+		f.ha[vmid] = fakeHA{State: r.PostForm.Get("state"), Group: r.PostForm.Get("group")}
+	case r.Method == http.MethodPut && rxFakeHaResource.MatchString(path):
+		vmid, _ := strconv.Atoi(rxFakeHaResource.FindStringSubmatch(path)[1])
+		if _, exists := f.ha[vmid]; !exists {
+			status = http.StatusInternalServerError
+			break
+		}
+		f.ha[vmid] = fakeHA{State: r.PostForm.Get("state"), Group: r.PostForm.Get("group")}
+	case r.Method == http.MethodDelete && rxFakeHaResource.MatchString(path):
+		vmid, _ := strconv.Atoi(rxFakeHaResource.FindStringSubmatch(path)[1])
+		delete(f.ha, vmid)
+	case r.Method == http.MethodDelete && rxFakeTask.MatchString(path):
+		task, ok := f.tasks[rxFakeTask.FindStringSubmatch(path)[2]]
+		if !ok {
+			status = http.StatusNotFound
+			break
+		}
+		task.Running, task.ExitStatus = false, "interrupted by signal"
+		task.Log = append(task.Log, "received interrupt")
+	case r.Method != http.MethodGet:
+		status = http.StatusNotImplemented
+	case rxFakeTaskStatus.MatchString(path):
+		task, ok := f.tasks[rxFakeTaskStatus.FindStringSubmatch(path)[2]]
+		if !ok {
+			status = http.StatusNotFound
+			break
+		}
+		if task.Running {
+			data = map[string]interface{}{"status": "running"}
+		} else {
+			data = map[string]interface{}{"status": "stopped", "exitstatus": task.ExitStatus, "endtime": time.Now().Unix()}
+		}
+	case rxFakeTaskLog.MatchString(path):
+		task, ok := f.tasks[rxFakeTaskLog.FindStringSubmatch(path)[2]]
+		if !ok {
+			status = http.StatusNotFound
+			break
+		}
+		var lines []interface{}
+		for i, line := range task.Log {
+			lines = append(lines, map[string]interface{}{"n": i + 1, "t": line})
+		}
+		data = lines
+	case rxFakeHaResource.MatchString(path):
+		vmid, _ := strconv.Atoi(rxFakeHaResource.FindStringSubmatch(path)[1])
+		resource, ok := f.ha[vmid]
+		if !ok {
+			// Proxmox puts the reason into the status line
+			http.Error(w, fmt.Sprintf("no such resource 'vm:%d'", vmid), http.StatusInternalServerError)
+			return
+		}
+		data = map[string]interface{}{"sid": fmt.Sprintf("vm:%d", vmid), "state": resource.State, "group": resource.Group}
+	case path == "/cluster/replication" || path == "/cluster/backup":
+		data = []interface{}{}
+	case path == "/nodes":
+		var nodes []interface{}
+		for name := range f.nodes {
+			nodes = append(nodes, map[string]interface{}{"node": name, "status": "online"})
+		}
+		data = nodes
+	case path == "/version":
+		data = map[string]interface{}{"version": "8.2.4", "release": "8.2"}
+	case path == "/cluster/resources":
+		data = f.resources()
+	case path == "/cluster/nextid":
+		data, status = f.nextID(r.URL.Query().Get("vmid"))
+	case rxFakeNodeStatus.MatchString(path):
+		node, ok := f.nodes[rxFakeNodeStatus.FindStringSubmatch(path)[1]]
+		if !ok {
+			status = http.StatusNotFound
+			break
+		}
+		data = map[string]interface{}{
+			"memory":  map[string]interface{}{"total": node.MemTotal, "used": node.MemUsed},
+			"cpuinfo": map[string]interface{}{"cpus": node.Cpus},
+		}
+	case rxFakeVmConfig.MatchString(path):
+		vm := f.vm(rxFakeVmConfig.FindStringSubmatch(path)[2])
+		if vm == nil {
+			status = http.StatusInternalServerError
+			break
+		}
+		data = vm.Config
+	case rxFakeVmStatus.MatchString(path):
+		vm := f.vm(rxFakeVmStatus.FindStringSubmatch(path)[2])
+		if vm == nil {
+			status = http.StatusInternalServerError
+			break
+		}
+		data = map[string]interface{}{"status": vm.Status, "name": vm.Name}
+	case rxFakeStorageStatus.MatchString(path):
+		avail, ok := f.storages[rxFakeStorageStatus.FindStringSubmatch(path)[2]]
+		if !ok {
+			status = http.StatusInternalServerError
+			break
+		}
+		data = map[string]interface{}{"avail": avail}
+	default:
+		status = http.StatusNotImplemented
+	}
+
+	if status != http.StatusOK {
+		http.Error(w, fmt.Sprintf("%d fake proxmox: %s %s", status, r.Method, path), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+}
+
+// Registers a task and returns its UPID
+func (f *fakeProxmox) startTask(node string, taskType string, id string) string {
+	upid := fmt.Sprintf("UPID:%s:%08X:%08X:%08X:%s:%s:root@pam:", node, len(f.tasks)+1000, 1, time.Now().Unix(), taskType, id)
+	task := &fakeTask{UPID: upid, Running: f.holdTasks, Log: []string{taskType + " " + id}}
+	if exit, ok := f.failTasks[taskType]; ok && !task.Running {
+		task.ExitStatus = exit
+		task.Log = append(task.Log, "TASK ERROR: "+exit)
+	} else if !task.Running {
+		task.ExitStatus = "OK"
+		task.Log = append(task.Log, "TASK OK")
+	}
+	f.tasks[upid] = task
+	return upid
+}
+
+func (f *fakeProxmox) vm(id string) *fakeVM {
+	vmid, _ := strconv.Atoi(id)
+	return f.vms[vmid]
+}
+
+// Lists the VMs like /cluster/resources?type=vm
+func (f *fakeProxmox) resources() []interface{} {
+	ids := make([]int, 0, len(f.vms))
+	for vmid := range f.vms {
+		ids = append(ids, vmid)
+	}
+	sort.Ints(ids)
+	list := []interface{}{}
+	for _, vmid := range ids {
+		vm := f.vms[vmid]
+		template := 0
+		if vm.Template {
+			template = 1
+		}
+		list = append(list, map[string]interface{}{
+			"id":       fmt.Sprintf("qemu/%d", vm.VmId),
+			"vmid":     vm.VmId,
+			"name":     vm.Name,
+			"node":     vm.Node,
+			"type":     "qemu",
+			"status":   vm.Status,
+			"template": template,
+			"maxmem":   vm.MaxMem,
+			"maxcpu":   vm.MaxCpu,
+		})
+	}
+	return list
+}
+
+// Returns the first free vmid, 400 if the requested one is taken
+func (f *fakeProxmox) nextID(requested string) (interface{}, int) {
+	if len(requested) != 0 {
+		vmid, _ := strconv.Atoi(requested)
+		if _, taken := f.vms[vmid]; taken {
+			return nil, http.StatusBadRequest
+		}
+		return strconv.Itoa(vmid), http.StatusOK
+	}
+	vmid := 100
+	for f.vms[vmid] != nil {
+		vmid++
+	}
+	return strconv.Itoa(vmid), http.StatusOK
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+/*
+RebuildState repopulates the vms and
+leases tables from proxmox. Every VM
+whose description carries the
+ownership marker of this instance is
+saved with its resources, address and
+a state derived from its kubernetes
+node. Nothing is written in dry-run.
+*/
+func (a *Autoscaler) RebuildState(dryRun bool) (int, error) {
+	cfg := a.config()
+	pool, _ := cfg.ipamPool()
+	recovered := 0
+	var errs []error
+	for _, cluster := range cfg.Clusters {
+		client := a.proxmoxClients()[cluster.Name]
+		if client == nil {
+			errs = append(errs, fmt.Errorf("cluster %s is unavailable", cluster.Name))
+			continue
+		}
+		n, err := a.rebuildCluster(cluster.Name, client, pool, dryRun)
+		recovered += n
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cluster %s: %w", cluster.Name, err))
+		}
+	}
+	return recovered, errors.Join(errs...)
+}
+
+// Recovers the managed VMs of a single cluster
+func (a *Autoscaler) rebuildCluster(cluster string, client *proxmox.Client, pool *IpamPool, dryRun bool) (int, error) {
+	records, err := a.recoverRecords(cluster, client)
+	if err != nil || dryRun {
+		return len(records), err
+	}
+	for i, record := range records {
+		if err := UpsertVmInfo(a.connStr, record); err != nil {
+			return i, err
+		}
+		if pool != nil && len(record.IP) != 0 {
+			if !pool.Contains(record.IP) {
+				ColorPrint(INFO, "Address %s of VM %d is not leasable from ipamCidr, no lease restored", record.IP, record.VmId)
+				continue
+			}
+			owner, err := RestoreLease(a.connStr, record.IP, record.VmId)
+			if err != nil {
+				return i + 1, err
+			}
+			if owner != record.VmId {
+				ColorPrint(WARN, "Address %s of VM %d is already leased to VM %d, check both VMs for an address conflict", record.IP, record.VmId, owner)
+			}
+		}
+	}
+	return len(records), nil
+}
+
+/*
+recoverRecords finds the VMs of this
+instance on a cluster and derives their
+records. A VM without a kubernetes node
+is recovered as failed.
+*/
+func (a *Autoscaler) recoverRecords(cluster string, client *proxmox.Client) ([]VmRecord, error) {
+	list, err := client.GetVmList()
+	if err != nil {
+		return nil, err
+	}
+	vms, _ := list["data"].([]interface{})
+	var records []VmRecord
+	for _, item := range vms {
+		vm, _ := item.(map[string]interface{})
+		id, ok := vm["vmid"].(float64)
+		if !ok || vm["type"] != "qemu" {
+			continue
+		}
+		if template, _ := vm["template"].(float64); template == 1 {
+			continue
+		}
+		vmr := proxmox.NewVmRef(int(id))
+		vmr.SetNode(fmt.Sprint(vm["node"]))
+		vmr.SetVmType("qemu")
+		if vmPool, ok := vm["pool"].(string); ok {
+			vmr.SetPool(vmPool)
+		}
+		config, err := proxmox.NewConfigQemuFromApi(vmr, client)
+		if err != nil {
+			ColorPrint(WARN, "Unable to read the config of VM %d: %v", vmr.VmId(), err)
+			continue
+		}
+		owner, ok := parseOwnership(config.Description)
+		if !ok || owner.Instance != a.config().InstanceId {
+			continue
+		}
+
+		record := VmRecord{
+			VmId:    vmr.VmId(),
+			Node:    vmr.Node(),
+			Pool:    config.Pool,
+			VmType:  vmr.GetVmType(),
+			Memory:  config.Memory,
+			Cores:   config.QemuCores,
+			Name:    config.Name,
+			Group:   owner.Group,
+			State:   VM_READY,
+			HaGroup: VmHaGroup(client, vmr.VmId()),
+			Cluster: cluster,
+		}
+		node, err := a.clientset.CoreV1().Nodes().Get(context.TODO(), config.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			record.State = VM_FAILED
+			record.Reason = "recovered from proxmox without a kubernetes node"
+		} else if err != nil {
+			return records, err
+		} else {
+			for _, address := range node.Status.Addresses {
+				if address.Type == v1.NodeInternalIP {
+					record.IP = address.Address
+					break
+				}
+			}
+		}
+		if len(record.IP) == 0 {
+			record.IP = staticAddress(config)
+		}
+
+		ColorPrint(INFO, "Recovered VM %d '%s' of group '%s' on node %s of cluster %s: state=%s ip=%s", record.VmId, record.Name, record.Group, record.Node, record.Cluster, record.State, record.IP)
+		records = append(records, record)
+	}
+	return records, nil
+}
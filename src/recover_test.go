@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Builds a VM whose description carries the ownership of instance
+func ownedVM(vmid int, name string, instance string, group string, ipconfig string) fakeVM {
+	owner := VmOwnership{Instance: instance, Group: group, Created: time.Now()}
+	return fakeVM{VmId: vmid, Name: name, Node: "pve", Status: "running", Config: map[string]interface{}{
+		"name":        name,
+		"description": owner.Description(),
+		"memory":      4096,
+		"cores":       2,
+		"ipconfig0":   ipconfig,
+	}}
+}
+
+func TestRecoverRecords(t *testing.T) {
+	backend := newFakeProxmox(t)
+	backend.addVM(testTemplate())
+	backend.addVM(ownedVM(120, "k8s-default-120", AUTOSCALER_NAME, DEFAULT_GROUP, "ip=dhcp"))
+	backend.addVM(ownedVM(121, "k8s-gpu-121", AUTOSCALER_NAME, "gpu", "ip=10.0.0.21/24,gw=10.0.0.1"))
+	backend.addVM(ownedVM(122, "k8s-default-122", "other-instance", DEFAULT_GROUP, "ip=dhcp"))
+	backend.addVM(fakeVM{VmId: 123, Name: "db", Node: "pve", Status: "running", Config: map[string]interface{}{"name": "db", "description": "database server"}})
+	backend.ha[120] = fakeHA{State: HA_STATE_STARTED, Group: "k8s"}
+	var records []VmRecord
+	a := newTestAutoscaler(testConfig(), backend.client(t), &records)
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "k8s-default-120"},
+		Status:     v1.NodeStatus{Addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.20"}}},
+	}
+	if _, err := a.clientset.CoreV1().Nodes().Create(context.Background(), node, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, err := a.recoverRecords(DEFAULT_CLUSTER, a.clients[DEFAULT_CLUSTER])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recovered) != 2 {
+		t.Fatalf("recovered %+v, want VMs 120 and 121", recovered)
+	}
+	joined, orphaned := recovered[0], recovered[1]
+	if joined.VmId != 120 || joined.State != VM_READY || joined.IP != "10.0.0.20" || joined.Group != DEFAULT_GROUP || joined.HaGroup != "k8s" || joined.Cluster != DEFAULT_CLUSTER {
+		t.Fatalf("VM with a node = %+v", joined)
+	}
+	if joined.Memory != 4096 || joined.Cores != 2 || joined.Node != "pve" {
+		t.Fatalf("resources of VM 120 = %+v", joined)
+	}
+	// A VM without a node keeps the address of its cloud-init config
+	if orphaned.VmId != 121 || orphaned.State != VM_FAILED || len(orphaned.Reason) == 0 || orphaned.IP != "10.0.0.21" || orphaned.Group != "gpu" {
+		t.Fatalf("VM without a node = %+v", orphaned)
+	}
+
+	// Nothing is written in dry-run mode
+	count, err := a.RebuildState(true)
+	if err != nil || count != 2 {
+		t.Fatalf("RebuildState() = %d, %v, want 2", count, err)
+	}
+	if writes := backend.count(`^(POST|PUT|DELETE) /(nodes|cluster)`); writes != 0 {
+		t.Fatalf("recovery sent %d writes to proxmox", writes)
+	}
+}
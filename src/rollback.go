@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+/*
+rollback cleans up after a VM that
+failed to provision in any phase. The
+Node object, the VM with its disks and
+the DB record are removed. With
+keepFailedVMs a VM that was created
+is left in place and its record is
+marked as failed with the reason
+instead. Failures of
+the join phase are reported as
+JoinFailed, all others as
+ProvisioningFailed.
+*/
+func (a *Autoscaler) rollback(client *proxmox.Client, vmid int, nodeName string, phase string, reason string) {
+	event := EVENT_PROVISION_FAILED
+	if phase == PHASE_JOIN {
+		event = EVENT_JOIN_FAILED
+	}
+	// The clone may have failed before the VM was created
+	exists, err := VmExists(client, vmid)
+	if err != nil {
+		ColorPrint(WARN, "Unable to check whether VM %d exists: %v", vmid, err)
+		exists = true
+	}
+	if a.config().KeepFailedVMs && exists {
+		ColorPrint(WARN, "Keeping failed VM %d for debugging: %s", vmid, reason)
+		if err := MarkVmFailed(a.connStr, vmid, reason); err != nil {
+			ColorPrint(WARN, "Unable to mark VM %d as failed in DB: %v", vmid, err)
+		}
+		a.events.Deployment(v1.EventTypeWarning, event, "VM %d failed in phase %s and was kept for debugging: %s", vmid, phase, reason)
+		return
+	}
+
+	ColorPrint(WARN, "Rolling back VM %d: %s", vmid, reason)
+	if len(nodeName) != 0 {
+		err := a.clientset.CoreV1().Nodes().Delete(context.TODO(), nodeName, metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			ColorPrint(WARN, "Unable to delete node '%s': %v", nodeName, err)
+		}
+	}
+
+	if exists {
+		if err := a.destroyWithRetry(client, vmid, false); err != nil {
+			ColorPrint(WARN, "VM %d could not be destroyed and needs to be removed manually: %v", vmid, err)
+			if err := MarkVmFailed(a.connStr, vmid, fmt.Sprintf("%s; destroy failed: %v", reason, err)); err != nil {
+				ColorPrint(WARN, "Unable to mark VM %d as failed in DB: %v", vmid, err)
+			}
+			return
+		}
+	} else {
+		a.releaseLease(vmid)
+	}
+
+	if err := DeleteVmInfo(a.connStr, vmid); err != nil {
+		ColorPrint(WARN, "Unable to delete the record of VM %d: %v", vmid, err)
+	}
+	a.events.Deployment(v1.EventTypeWarning, event, "VM %d failed in phase %s and was destroyed: %s", vmid, phase, reason)
+}
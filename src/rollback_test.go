@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRollbackEventReason(t *testing.T) {
+	tests := []struct {
+		phase  string
+		keep   bool
+		exists bool
+		reason string
+		kept   bool
+	}{
+		{PHASE_CLONING, false, false, EVENT_PROVISION_FAILED, false},
+		{PHASE_IP, false, false, EVENT_PROVISION_FAILED, false},
+		{PHASE_JOIN, false, false, EVENT_JOIN_FAILED, false},
+		{PHASE_JOIN, true, true, EVENT_JOIN_FAILED, true},
+		{PHASE_AGENT, true, true, EVENT_PROVISION_FAILED, true},
+		// A clone that failed leaves nothing to keep
+		{PHASE_CLONING, true, false, EVENT_PROVISION_FAILED, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.phase, func(t *testing.T) {
+			backend := newFakeProxmox(t)
+			if tt.exists {
+				backend.addVM(fakeVM{VmId: 120, Name: "k8s-default-120", Node: "pve"})
+			}
+			var records []VmRecord
+			cfg := testConfig()
+			cfg.KeepFailedVMs = tt.keep
+			a := newTestAutoscaler(cfg, backend.client(t), &records)
+
+			a.rollback(a.clients[DEFAULT_CLUSTER], 120, "", tt.phase, "boom")
+			a.Close()
+			events, err := a.clientset.CoreV1().Events(podNamespace()).List(context.Background(), metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events.Items) != 1 {
+				t.Fatalf("%d events written, want 1", len(events.Items))
+			}
+			event := events.Items[0]
+			if event.Reason != tt.reason || !strings.Contains(event.Message, "failed in phase "+tt.phase) {
+				t.Fatalf("event = %s: %s", event.Reason, event.Message)
+			}
+			if kept := strings.Contains(event.Message, "kept for debugging"); kept != tt.kept {
+				t.Fatalf("kept = %v, want %v: %s", kept, tt.kept, event.Message)
+			}
+			if _, ok := backend.vms[120]; ok != tt.exists {
+				t.Fatalf("VM 120 exists = %v after the rollback", ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	STATUS_CONFIGMAP = AUTOSCALER_NAME + "-status"
+	STATUS_KEY       = "status"
+
+	// Phase changes within this window are written together
+	STATUS_WRITE_DELAY = 5 * time.Second
+)
+
+/*
+Provisioning phases reported in
+the status ConfigMap
+*/
+const (
+	PHASE_CLONING = "Cloning"
+	PHASE_START   = "Starting"
+	PHASE_HA      = "RegisteringHA"
+	PHASE_AGENT   = "WaitingForAgent"
+	PHASE_IP      = "WaitingForIP"
+	PHASE_JOIN    = "Joining"
+	PHASE_LABEL   = "Labeling"
+)
+
+// Usage of a single kubernetes node, CpuUsage and MemUsage in percent
+type NodeUtilization struct {
+	Name     string
+	UsedCpu  int64
+	TotalCpu int64
+	CpuUsage float32
+	UsedMem  string
+	TotalMem string
+	MemUsage float32
+}
+
+// Outcome of the last scaling action
+type ScalingResult struct {
+	Time   time.Time
+	Result string
+}
+
+// A VM that is still being provisioned
+type InFlightVM struct {
+	Group string
+	VmId  int
+	Phase string
+	Since time.Time
+}
+
+/*
+AutoscalerStatus is the state shown in
+the status ConfigMap. It is updated
+by the main loop and the scaling
+functions and is safe to use from
+multiple goroutines.
+*/
+type AutoscalerStatus struct {
+	mu            sync.Mutex
+	nodes         []NodeUtilization
+	cpuUsage      float32
+	memUsage      float32
+	lastScaleUp   ScalingResult
+	lastScaleDown ScalingResult
+	inFlight      map[int]*InFlightVM
+	nextID        int
+	infraFull     map[string]ScalingResult
+	infraFullHits int
+}
+
+func NewAutoscalerStatus() *AutoscalerStatus {
+	return &AutoscalerStatus{inFlight: map[int]*InFlightVM{}, infraFull: map[string]ScalingResult{}}
+}
+
+/*
+InfrastructureFull records that a
+scale-up of the group was refused
+because proxmox had no capacity left
+*/
+func (s *AutoscalerStatus) InfrastructureFull(group string, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.infraFull[group] = ScalingResult{Time: time.Now(), Result: reason}
+	s.infraFullHits++
+	infraFullTotal.Inc(group)
+}
+
+// Clears the infrastructure full state of a group
+func (s *AutoscalerStatus) InfrastructureAvailable(group string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.infraFull, group)
+}
+
+// Saves the utilization of the last reconcile cycle
+func (s *AutoscalerStatus) SetUtilization(nodes []NodeUtilization, cpuUsage float32, memUsage float32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nodes = nodes
+	s.cpuUsage = cpuUsage
+	s.memUsage = memUsage
+}
+
+// Saves the result of a scale-up
+func (s *AutoscalerStatus) ScaleUpDone(result string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastScaleUp = ScalingResult{Time: time.Now(), Result: result}
+}
+
+// Saves the result of a scale-down
+func (s *AutoscalerStatus) ScaleDownDone(result string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastScaleDown = ScalingResult{Time: time.Now(), Result: result}
+}
+
+/*
+StartProvisioning registers a new
+in-flight VM for the group and
+returns the id used to update it.
+*/
+func (s *AutoscalerStatus) StartProvisioning(group string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	s.inFlight[s.nextID] = &InFlightVM{Group: group, Phase: PHASE_CLONING, Since: time.Now()}
+	return s.nextID
+}
+
+// Moves an in-flight VM to a new phase
+func (s *AutoscalerStatus) SetPhase(id int, vmid int, phase string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if vm, ok := s.inFlight[id]; ok {
+		vm.VmId = vmid
+		vm.Phase = phase
+		vm.Since = time.Now()
+	}
+}
+
+// Returns the phase of an in-flight VM
+func (s *AutoscalerStatus) Phase(id int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if vm, ok := s.inFlight[id]; ok {
+		return vm.Phase
+	}
+	return ""
+}
+
+// Counts in-flight VMs of a group whose vmid is not in recorded yet
+func (s *AutoscalerStatus) Unrecorded(group string, recorded map[int]bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for _, vm := range s.inFlight {
+		if vm.Group == group && (vm.VmId == 0 || !recorded[vm.VmId]) {
+			count++
+		}
+	}
+	return count
+}
+
+// Removes a VM that is no longer being provisioned
+func (s *AutoscalerStatus) FinishProvisioning(id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inFlight, id)
+}
+
+/*
+Render formats the status as human
+readable text, similar to the status
+written by the upstream
+cluster-autoscaler.
+*/
+func (s *AutoscalerStatus) Render(cfg *Config, records []VmRecord) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Cluster-autoscaler status at %s:\n", time.Now().UTC().Format(time.RFC3339))
+
+	fmt.Fprintf(&b, "Utilization:\n")
+	fmt.Fprintf(&b, "  Overall: cpu=%.1f%% mem=%.1f%% (limits: cpu=%d%% mem=%d%%)\n", s.cpuUsage, s.memUsage, cfg.CpuLimit, cfg.MemoryLimit)
+	for _, node := range s.nodes {
+		fmt.Fprintf(&b, "  Node %s: cpu=%dm/%dm (%.1f%%) mem=%s/%s (%.1f%%)\n", node.Name, node.UsedCpu, node.TotalCpu, node.CpuUsage, node.UsedMem, node.TotalMem, node.MemUsage)
+	}
+
+	fmt.Fprintf(&b, "\nNodeGroups:\n")
+	for _, group := range cfg.NodeGroups {
+		managed := 0
+		for _, record := range records {
+			if record.Group == group.Name {
+				managed++
+			}
+		}
+		fmt.Fprintf(&b, "  Name: %s\n", group.Name)
+		fmt.Fprintf(&b, "    Template: %s on node %s\n", group.TemplateName, group.NodeName)
+		fmt.Fprintf(&b, "    Managed VMs: %d\n", managed)
+		if full, ok := s.infraFull[group.Name]; ok {
+			fmt.Fprintf(&b, "    InfrastructureFull: since=%s reason=%s\n", full.Time.UTC().Format(time.RFC3339), full.Result)
+		}
+	}
+	fmt.Fprintf(&b, "  InfrastructureFullTotal: %d\n", s.infraFullHits)
+
+	fmt.Fprintf(&b, "\nScaleUp:\n%s", renderResult(s.lastScaleUp))
+	fmt.Fprintf(&b, "\nScaleDown:\n%s", renderResult(s.lastScaleDown))
+
+	fmt.Fprintf(&b, "\nInFlight:\n")
+	if len(s.inFlight) == 0 {
+		fmt.Fprintf(&b, "  None\n")
+	}
+	ids := make([]int, 0, len(s.inFlight))
+	for id := range s.inFlight {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		vm := s.inFlight[id]
+		fmt.Fprintf(&b, "  Group %s: vmid=%d phase=%s since=%s\n", vm.Group, vm.VmId, vm.Phase, vm.Since.UTC().Format(time.RFC3339))
+	}
+	return b.String()
+}
+
+func renderResult(result ScalingResult) string {
+	if result.Time.IsZero() {
+		return "  Never\n"
+	}
+	return fmt.Sprintf("  LastTime: %s\n  Result: %s\n", result.Time.UTC().Format(time.RFC3339), result.Result)
+}
+
+/*
+WriteStatus renders the status and
+creates or updates the status
+ConfigMap in the autoscaler namespace.
+Failures are only logged so that they
+never block scaling.
+*/
+func (a *Autoscaler) WriteStatus() {
+	records, err := a.listVms()
+	if err != nil {
+		ColorPrint(WARN, "Unable to list managed VMs for the status ConfigMap: %v", err)
+	}
+	namespace := podNamespace()
+	configMaps := a.clientset.CoreV1().ConfigMaps(namespace)
+	data := map[string]string{STATUS_KEY: a.status.Render(a.config(), records)}
+
+	configMap, err := configMaps.Get(context.TODO(), STATUS_CONFIGMAP, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = configMaps.Create(context.TODO(), &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: STATUS_CONFIGMAP, Namespace: namespace},
+			Data:       data,
+		}, metav1.CreateOptions{})
+	} else if err == nil {
+		configMap.Data = data
+		_, err = configMaps.Update(context.TODO(), configMap, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		ColorPrint(WARN, "Unable to write the status ConfigMap: %v", err)
+	}
+}
+
+/*
+setPhase moves an in-flight VM to a new
+phase. The ConfigMap is written once
+STATUS_WRITE_DELAY after the first
+change, so parallel provisions do not
+rewrite it on every phase.
+*/
+func (a *Autoscaler) setPhase(id int, vmid int, phase string) {
+	a.status.SetPhase(id, vmid, phase)
+	a.statusMu.Lock()
+	defer a.statusMu.Unlock()
+	if a.statusWrite != nil {
+		return
+	}
+	a.statusWrite = time.AfterFunc(STATUS_WRITE_DELAY, func() {
+		a.statusMu.Lock()
+		a.statusWrite = nil
+		a.statusMu.Unlock()
+		a.WriteStatus()
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// Returns the status written to the ConfigMap
+func writtenStatus(t *testing.T, a *Autoscaler) string {
+	t.Helper()
+	configMap, err := a.clientset.CoreV1().ConfigMaps(podNamespace()).Get(context.Background(), STATUS_CONFIGMAP, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return configMap.Data[STATUS_KEY]
+}
+
+func TestWriteStatus(t *testing.T) {
+	records := []VmRecord{{VmId: 120, Group: DEFAULT_GROUP}, {VmId: 121, Group: DEFAULT_GROUP}, {VmId: 130, Group: "gpu"}}
+	a := newTestAutoscaler(testConfig(), nil, &records)
+	defer a.Close()
+
+	a.WriteStatus()
+	status := writtenStatus(t, a)
+	for _, want := range []string{
+		"Name: default\n    Template: template on node pve\n    Managed VMs: 2\n",
+		"Name: gpu\n    Template: template on node pve\n    Managed VMs: 1\n",
+		"ScaleUp:\n  Never\n",
+		"InFlight:\n  None\n",
+	} {
+		if !strings.Contains(status, want) {
+			t.Fatalf("status does not contain %q:\n%s", want, status)
+		}
+	}
+
+	// The existing ConfigMap is updated in place
+	a.status.ScaleUpDone("Succeeded for group default")
+	a.status.InfrastructureFull("gpu", "node pve has 1.0G free")
+	id := a.status.StartProvisioning(DEFAULT_GROUP)
+	a.status.SetPhase(id, 122, PHASE_JOIN)
+	a.WriteStatus()
+	status = writtenStatus(t, a)
+	for _, want := range []string{
+		"Result: Succeeded for group default",
+		"InfrastructureFull: since=",
+		"reason=node pve has 1.0G free",
+		"InfrastructureFullTotal: 1",
+		"Group default: vmid=122 phase=" + PHASE_JOIN,
+	} {
+		if !strings.Contains(status, want) {
+			t.Fatalf("updated status does not contain %q:\n%s", want, status)
+		}
+	}
+	configMaps, err := a.clientset.CoreV1().ConfigMaps(podNamespace()).List(context.Background(), metav1.ListOptions{})
+	if err != nil || len(configMaps.Items) != 1 {
+		t.Fatalf("%d ConfigMaps written, want 1: %v", len(configMaps.Items), err)
+	}
+}
+
+func TestWriteStatusWithoutRecords(t *testing.T) {
+	var records []VmRecord
+	a := newTestAutoscaler(testConfig(), nil, &records)
+	defer a.Close()
+	// The status is still written when the DB can not be read
+	a.listVms = func() ([]VmRecord, error) { return nil, errors.New("connection refused") }
+
+	a.WriteStatus()
+	if status := writtenStatus(t, a); !strings.Contains(status, "Managed VMs: 0") {
+		t.Fatalf("status = %s", status)
+	}
+}
+
+func TestSetPhaseBatchesWrites(t *testing.T) {
+	var records []VmRecord
+	a := newTestAutoscaler(testConfig(), nil, &records)
+	defer a.Close()
+	id := a.status.StartProvisioning(DEFAULT_GROUP)
+
+	a.setPhase(id, 120, PHASE_START)
+	a.statusMu.Lock()
+	first := a.statusWrite
+	a.statusMu.Unlock()
+	a.setPhase(id, 120, PHASE_AGENT)
+	a.statusMu.Lock()
+	second := a.statusWrite
+	a.statusMu.Unlock()
+	if first == nil || first != second {
+		t.Fatal("every phase change scheduled its own status write")
+	}
+	first.Stop()
+	if phase := a.status.Phase(id); phase != PHASE_AGENT {
+		t.Fatalf("Phase() = %s, want %s", phase, PHASE_AGENT)
+	}
+	for _, action := range a.clientset.(*fake.Clientset).Actions() {
+		if action.GetResource().Resource == "configmaps" {
+			t.Fatalf("status was written before STATUS_WRITE_DELAY: %v", action)
+		}
+	}
+}
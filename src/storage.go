@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+)
+
+var (
+	rxDiskKey    = regexp.MustCompile(`^(scsi|virtio|sata|ide)[0-9]+$`)
+	rxDiskResize = regexp.MustCompile(`^\+?[0-9]+[KMGT]$`)
+)
+
+/*
+CloneOptions control how the template
+of a node group is cloned: full or
+linked, the storage of the new disks
+and an optional resize of one disk.
+*/
+type CloneOptions struct {
+	Full           bool
+	Storage        string
+	ResizeDiskName string
+	ResizeDiskBy   string
+}
+
+// A disk attached to a VM
+type vmDisk struct {
+	Name    string
+	Storage string
+	SizeGB  float64
+}
+
+// Returns the clone options of the group on a proxmox node
+func (g *NodeGroup) cloneOptions(node string) CloneOptions {
+	storage := g.Storage
+	if nodeStorage, ok := g.StorageByNode[node]; ok {
+		storage = nodeStorage
+	}
+	return CloneOptions{
+		Full:           g.FullClone == nil || *g.FullClone,
+		Storage:        storage,
+		ResizeDiskName: g.ResizeDiskName,
+		ResizeDiskBy:   g.ResizeDiskBy,
+	}
+}
+
+/*
+forConfig returns the options with the
+storage the clone of config really
+goes to. Without a storage of the
+group the one of the first disk, or
+else of the config, is used like the
+clone request does.
+*/
+func (o CloneOptions) forConfig(config *proxmox.ConfigQemu) CloneOptions {
+	if len(o.Storage) == 0 {
+		o.Storage = cloneStorage(config)
+	}
+	return o
+}
+
+// Returns the storage a full clone of the config is placed on
+func cloneStorage(config *proxmox.ConfigQemu) string {
+	if disk0Storage, ok := config.QemuDisks[0]["storage"].(string); ok && len(disk0Storage) != 0 {
+		return disk0Storage
+	}
+	return config.Storage
+}
+
+// Checks the diskResize setting of a group
+func validateDiskResize(size string) error {
+	if len(size) != 0 && !rxDiskResize.MatchString(size) {
+		return errors.New("diskResize must be a size with a unit of K, M, G or T like '+10G' or '40G': " + size)
+	}
+	return nil
+}
+
+/*
+vmDisks lists the disks of a VM config
+as returned by the API, e.g.
+scsi0: "local-lvm:base-9000-disk-0,size=32G".
+Cloud-init drives and CD-ROMs are skipped.
+*/
+func vmDisks(config map[string]interface{}) []vmDisk {
+	var disks []vmDisk
+	for key, value := range config {
+		spec, ok := value.(string)
+		if !rxDiskKey.MatchString(key) || !ok || strings.Contains(spec, "media=cdrom") || strings.Contains(spec, "cloudinit") {
+			continue
+		}
+		options := strings.Split(spec, ",")
+		disk := vmDisk{Name: key, Storage: strings.SplitN(options[0], ":", 2)[0]}
+		for _, option := range options[1:] {
+			if size, found := strings.CutPrefix(option, "size="); found {
+				disk.SizeGB = proxmox.DiskSizeGB(size)
+			}
+		}
+		disks = append(disks, disk)
+	}
+	return disks
+}
+
+// Returns the GB a resize adds to a disk of the current size
+func resizeGB(current float64, resize string) float64 {
+	if len(resize) == 0 {
+		return 0
+	}
+	size := proxmox.DiskSizeGB(strings.TrimPrefix(resize, "+"))
+	if strings.HasPrefix(resize, "+") {
+		return size
+	}
+	if size > current {
+		return size - current
+	}
+	return 0
+}
+
+/*
+checkStorageRoom makes sure the target
+storages on the node have room for a
+full clone of the template including
+the resize. Linked clones share the
+disks of the template and are not
+checked.
+*/
+func checkStorageRoom(client *proxmox.Client, sourceVmr *proxmox.VmRef, node string, opts CloneOptions) error {
+	if !opts.Full {
+		return nil
+	}
+	config, err := client.GetVmConfig(sourceVmr)
+	if err != nil {
+		return err
+	}
+	needed := map[string]float64{}
+	for _, disk := range vmDisks(config) {
+		storage := disk.Storage
+		if len(opts.Storage) != 0 {
+			storage = opts.Storage
+		}
+		size := disk.SizeGB
+		if disk.Name == opts.ResizeDiskName {
+			size += resizeGB(size, opts.ResizeDiskBy)
+		}
+		needed[storage] += size
+	}
+
+	vmr := proxmox.NewVmRef(sourceVmr.VmId())
+	vmr.SetNode(node)
+	vmr.SetVmType("qemu")
+	for storage, sizeGB := range needed {
+		status, err := client.GetStorageStatus(vmr, storage)
+		if err != nil {
+			return fmt.Errorf("unable to read storage '%s' on node %s: %w", storage, node, err)
+		}
+		avail, _ := status["avail"].(float64)
+		if availGB := avail / (1 << 30); availGB < sizeGB {
+			return fmt.Errorf("storage '%s' on node %s has %sG free but the clone needs %sG", storage, node,
+				strconv.FormatFloat(availGB, 'f', 1, 64), strconv.FormatFloat(sizeGB, 'f', 1, 64))
+		}
+	}
+	return nil
+}
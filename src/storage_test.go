@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateDiskResize(t *testing.T) {
+	tests := []struct {
+		size  string
+		valid bool
+	}{
+		{"", true},
+		{"+10G", true},
+		{"40G", true},
+		{"+512M", true},
+		{"1T", true},
+		{"10", false},
+		{"+10", false},
+		{"10GB", false},
+		{"-5G", false},
+		{"+1.5G", false},
+	}
+	for _, tt := range tests {
+		if err := validateDiskResize(tt.size); (err == nil) != tt.valid {
+			t.Errorf("validateDiskResize(%q) = %v, want valid %t", tt.size, err, tt.valid)
+		}
+	}
+}
+
+func TestCloneOptionsForConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		group   string
+		config  string
+		storage string
+	}{
+		{"group storage wins", "ceph", TEST_CLONE_CONFIG, "ceph"},
+		{"first disk", "", TEST_CLONE_CONFIG, "fast-lvm"},
+		{"config storage", "", `{"storage": "slow-lvm"}`, "slow-lvm"},
+		{"template storage", "", `{}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := parseQemuConfig([]byte(tt.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := (CloneOptions{Storage: tt.group}).forConfig(config).Storage; got != tt.storage {
+				t.Fatalf("forConfig().Storage = %q, want %q", got, tt.storage)
+			}
+		})
+	}
+}
+
+func TestCheckStorageRoom(t *testing.T) {
+	backend := newFakeProxmox(t)
+	backend.storages["fast-lvm"] = 20 << 30
+	backend.addVM(fakeVM{VmId: 9000, Name: "template", Node: "pve", Template: true, Config: map[string]interface{}{
+		"scsi0": "local-lvm:base-9000-disk-0,size=16G",
+		"ide2":  "local-lvm:vm-9000-cloudinit,media=cdrom",
+	}})
+	client := backend.client(t)
+	vmrs, err := client.GetVmRefsByName("template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := parseQemuConfig([]byte(TEST_CLONE_CONFIG))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		opts    CloneOptions
+		wantErr string
+	}{
+		{"linked clone", CloneOptions{Full: false, ResizeDiskName: "scsi0", ResizeDiskBy: "+1T"}, ""},
+		{"fits on the disk storage", CloneOptions{Full: true}.forConfig(config), ""},
+		{"resize beyond the disk storage", CloneOptions{Full: true, ResizeDiskName: "scsi0", ResizeDiskBy: "+8G"}.forConfig(config), "storage 'fast-lvm'"},
+		{"absolute resize", CloneOptions{Full: true, ResizeDiskName: "scsi0", ResizeDiskBy: "30G"}.forConfig(config), "needs 30.0G"},
+		{"group storage", CloneOptions{Full: true, Storage: "local-lvm", ResizeDiskName: "scsi0", ResizeDiskBy: "+100G"}.forConfig(config), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkStorageRoom(client, vmrs[0], "pve", tt.opts)
+			if len(tt.wantErr) == 0 && err != nil {
+				t.Fatal(err)
+			}
+			if len(tt.wantErr) != 0 && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("checkStorageRoom() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+)
+
+const (
+	// Task log lines kept in a TaskError
+	TASK_LOG_LINES = 20
+	// Poll interval while a task is still running
+	TASK_POLL_PERIOD = 2 * time.Second
+)
+
+/*
+UPID identifies a proxmox task, e.g.
+UPID:pve1:000A1B2C:0581C2D3:62F0A1B2:qmstart:105:root@pam:
+*/
+type UPID struct {
+	Raw       string
+	Node      string
+	StartTime time.Time
+	Type      string
+	ID        string
+	User      string
+}
+
+// Parses a task UPID
+func ParseUPID(raw string) (*UPID, error) {
+	parts := strings.Split(raw, ":")
+	if len(parts) < 8 || parts[0] != "UPID" {
+		return nil, errors.New("invalid UPID: " + raw)
+	}
+	start, err := strconv.ParseInt(parts[4], 16, 64)
+	if err != nil {
+		return nil, errors.New("invalid start time in UPID: " + raw)
+	}
+	return &UPID{
+		Raw:       raw,
+		Node:      parts[1],
+		StartTime: time.Unix(start, 0),
+		Type:      parts[5],
+		ID:        parts[6],
+		User:      parts[7],
+	}, nil
+}
+
+// State of a proxmox task
+type TaskStatus struct {
+	UPID       *UPID
+	Running    bool
+	ExitStatus string
+	Duration   time.Duration
+}
+
+func (t *TaskStatus) String() string {
+	return fmt.Sprintf("task %s of %s %s finished with '%s' after %s", t.UPID.Type, t.UPID.Node, t.UPID.ID, t.ExitStatus, t.Duration.Round(time.Second))
+}
+
+// Describes a tracked task or returns an empty string
+func taskSummary(task *TaskStatus) string {
+	if task == nil {
+		return ""
+	}
+	return task.String()
+}
+
+/*
+TaskError is returned when a proxmox
+task fails. It carries the exit status
+and the last lines of the task log.
+*/
+type TaskError struct {
+	Task *TaskStatus
+	Log  []string
+	Err  error
+}
+
+func (e *TaskError) Error() string {
+	msg := fmt.Sprintf("%s failed: %v", e.Task.UPID.Type, e.Err)
+	if len(e.Task.ExitStatus) != 0 {
+		msg += fmt.Sprintf(" (exit status '%s' after %s, %s)", e.Task.ExitStatus, e.Task.Duration.Round(time.Second), e.Task.UPID.Raw)
+	}
+	if len(e.Log) != 0 {
+		msg += "\n  task log:\n    " + strings.Join(e.Log, "\n    ")
+	}
+	return msg
+}
+
+func (e *TaskError) Unwrap() error {
+	return e.Err
+}
+
+// Reads the status of a task
+func GetTaskStatus(client *proxmox.Client, upid *UPID) (*TaskStatus, error) {
+	var data map[string]interface{}
+	err := client.GetJsonRetryable(fmt.Sprintf("/nodes/%s/tasks/%s/status", upid.Node, url.PathEscape(upid.Raw)), &data, 3)
+	if err != nil {
+		return nil, err
+	}
+	status, _ := data["data"].(map[string]interface{})
+	task := &TaskStatus{UPID: upid, Running: status["status"] == "running"}
+	task.ExitStatus, _ = status["exitstatus"].(string)
+	end := time.Now()
+	if endTime, ok := status["endtime"].(float64); ok && !task.Running {
+		end = time.Unix(int64(endTime), 0)
+	}
+	task.Duration = end.Sub(upid.StartTime)
+	return task, nil
+}
+
+// Reads the last lines of a task log
+func GetTaskLog(client *proxmox.Client, upid *UPID, lines int) ([]string, error) {
+	var data map[string]interface{}
+	err := client.GetJsonRetryable(fmt.Sprintf("/nodes/%s/tasks/%s/log?limit=%d&start=0", upid.Node, url.PathEscape(upid.Raw), 5000), &data, 3)
+	if err != nil {
+		return nil, err
+	}
+	entries, _ := data["data"].([]interface{})
+	var log []string
+	for _, entry := range entries {
+		if line, ok := entry.(map[string]interface{})["t"].(string); ok {
+			log = append(log, line)
+		}
+	}
+	if len(log) > lines {
+		log = log[len(log)-lines:]
+	}
+	return log, nil
+}
+
+// Polls a task until it stops or ctx is done
+func WaitForTask(ctx context.Context, client *proxmox.Client, upid *UPID) (*TaskStatus, error) {
+	for {
+		task, err := GetTaskStatus(client, upid)
+		if err != nil {
+			return nil, err
+		}
+		if !task.Running {
+			return task, nil
+		}
+		select {
+		case <-ctx.Done():
+			return task, fmt.Errorf("task %s is still running: %w", upid.Raw, ctx.Err())
+		case <-time.After(TASK_POLL_PERIOD):
+		}
+	}
+}
+
+/*
+AwaitTask waits for a task started
+with StartTask. A TaskError with the
+end of the task log is returned when
+it did not finish with OK or ctx was
+done first.
+*/
+func AwaitTask(ctx context.Context, client *proxmox.Client, upid *UPID) (*TaskStatus, error) {
+	task, err := WaitForTask(ctx, client, upid)
+	if err == nil && task.ExitStatus != "OK" {
+		err = errors.New(task.ExitStatus)
+	}
+	if err != nil {
+		return task, taskError(client, upid, task, err)
+	}
+	ColorPrint(INFO, "Proxmox %s", task)
+	return task, nil
+}
+
+// Wraps err in a TaskError carrying the end of the task log
+func taskError(client *proxmox.Client, upid *UPID, task *TaskStatus, err error) *TaskError {
+	if task == nil {
+		task = &TaskStatus{UPID: upid}
+	}
+	log, logErr := GetTaskLog(client, upid, TASK_LOG_LINES)
+	if logErr != nil {
+		ColorPrint(WARN, "Unable to read the log of task %s: %v", upid.Raw, logErr)
+	}
+	return &TaskError{Task: task, Log: log, Err: err}
+}
+
+/*
+RunTask starts a proxmox task and waits
+for the UPID it returned until the task
+ends, ctx is done or taskTimeout
+expires.
+*/
+func RunTask(ctx context.Context, client *proxmox.Client, method string, path string, params url.Values) (*TaskStatus, error) {
+	upid, err := StartTask(ctx, client, method, path, params)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(client.TaskTimeout)*time.Second)
+	defer cancel()
+	return AwaitTask(ctx, client, upid)
+}
+
+/*
+apiClients keeps the url and the http
+client every proxmox.Client was created
+with. The library waits for the tasks
+it starts, so requests that should only
+return the UPID are sent through them.
+*/
+var apiClients sync.Map
+
+type apiClient struct {
+	url  string
+	http *http.Client
+}
+
+// Remembers how to send raw requests for a client
+func registerApiClient(client *proxmox.Client, apiUrl string, hclient *http.Client) {
+	apiClients.Store(client, &apiClient{url: apiUrl, http: hclient})
+}
+
+/*
+ApiError is a request that proxmox did
+not answer with 200. Proxmox puts the
+reason into the status line.
+*/
+type ApiError struct {
+	Method string
+	Path   string
+	Status string
+	Body   string
+}
+
+func (e *ApiError) Error() string {
+	return fmt.Sprintf("%s %s failed: %s %s", e.Method, e.Path, e.Status, e.Body)
+}
+
+/*
+apiRequest sends a request with the
+credentials of the client and returns
+the data field of the answer. Params
+of GET and DELETE go into the query,
+all others into a form body.
+*/
+func apiRequest(ctx context.Context, client *proxmox.Client, method string, path string, params url.Values) (json.RawMessage, error) {
+	value, ok := apiClients.Load(client)
+	if !ok {
+		return nil, errors.New("no http client registered for proxmox client " + client.ApiUrl)
+	}
+	api := value.(*apiClient)
+	var body io.Reader
+	if method == http.MethodGet || method == http.MethodDelete {
+		if len(params) != 0 {
+			path += "?" + params.Encode()
+		}
+	} else if len(params) != 0 {
+		body = strings.NewReader(params.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, api.url+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := api.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, &ApiError{Method: method, Path: path, Status: resp.Status, Body: strings.TrimSpace(string(msg))}
+	}
+	var answer struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return nil, err
+	}
+	return answer.Data, nil
+}
+
+// Sends a request that starts a task and returns its UPID without waiting
+func StartTask(ctx context.Context, client *proxmox.Client, method string, path string, params url.Values) (*UPID, error) {
+	data, err := apiRequest(ctx, client, method, path, params)
+	if err != nil {
+		return nil, err
+	}
+	var raw string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s %s did not return a task: %s", method, path, data)
+	}
+	return ParseUPID(raw)
+}
+
+// Stops a running task, e.g. a clone that ran past its deadline
+func StopTask(client *proxmox.Client, upid *UPID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := apiRequest(ctx, client, http.MethodDelete, fmt.Sprintf("/nodes/%s/tasks/%s", upid.Node, url.PathEscape(upid.Raw)), nil)
+	return err
+}
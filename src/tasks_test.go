@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseUPID(t *testing.T) {
+	upid, err := ParseUPID("UPID:pve1:000A1B2C:0581C2D3:62F0A1B2:qmstart:105:root@pam:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upid.Node != "pve1" || upid.Type != "qmstart" || upid.ID != "105" || upid.User != "root@pam" || !upid.StartTime.Equal(time.Unix(0x62F0A1B2, 0)) {
+		t.Fatalf("ParseUPID() = %+v", upid)
+	}
+	for _, raw := range []string{"", "UPID:pve1:qmstart", "TASK:pve1:000A1B2C:0581C2D3:62F0A1B2:qmstart:105:root@pam:", "UPID:pve1:000A1B2C:0581C2D3:zz:qmstart:105:root@pam:"} {
+		if _, err := ParseUPID(raw); err == nil {
+			t.Errorf("ParseUPID(%q) accepted an invalid UPID", raw)
+		}
+	}
+}
+
+/*
+Tasks are tracked by the UPID their
+request returned, even when other tasks
+of the same type ran for the VM in the
+same second.
+*/
+func TestRunTaskTracksReturnedUPID(t *testing.T) {
+	backend := newFakeProxmox(t)
+	backend.addVM(fakeVM{VmId: 120, Name: "k8s-default-120", Node: "pve"})
+	client := backend.client(t)
+	backend.mu.Lock()
+	older := backend.startTask("pve", "qmstart", "120")
+	backend.tasks[older].ExitStatus = "start failed: older attempt"
+	backend.mu.Unlock()
+
+	summary, err := StartVM(context.Background(), client, 120)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(summary, "finished with 'OK'") {
+		t.Fatalf("StartVM() = %s", summary)
+	}
+	if backend.count(`^GET /nodes/pve/tasks$`) != 0 {
+		t.Fatal("the task list was searched for the UPID")
+	}
+	if backend.vms[120].Status != "running" {
+		t.Fatal("VM was not started")
+	}
+}
+
+func TestRunTaskFailure(t *testing.T) {
+	backend := newFakeProxmox(t)
+	backend.addVM(fakeVM{VmId: 120, Name: "k8s-default-120", Node: "pve"})
+	backend.failTasks = map[string]string{"qmstart": "start failed: storage 'fast-lvm' is not online"}
+	client := backend.client(t)
+
+	_, err := StartVM(context.Background(), client, 120)
+	var taskErr *TaskError
+	if !errors.As(err, &taskErr) {
+		t.Fatalf("StartVM() = %v, want a TaskError", err)
+	}
+	if taskErr.Task.ExitStatus != backend.failTasks["qmstart"] || !strings.Contains(strings.Join(taskErr.Log, "\n"), "TASK ERROR") {
+		t.Fatalf("TaskError = %+v", taskErr)
+	}
+
+	if _, err := RunTask(context.Background(), client, http.MethodPost, "/nodes/pve/qemu/999/status/start", nil); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Fatalf("RunTask() of a missing VM = %v", err)
+	}
+}
+
+func TestRunTaskDeadline(t *testing.T) {
+	backend := newFakeProxmox(t)
+	backend.addVM(fakeVM{VmId: 120, Name: "k8s-default-120", Node: "pve"})
+	backend.holdTasks = true
+	client := backend.client(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	task, err := RunTask(ctx, client, http.MethodPost, "/nodes/pve/qemu/120/status/start", nil)
+	if !errors.Is(err, context.DeadlineExceeded) || task == nil || !task.Running {
+		t.Fatalf("RunTask() = %+v, %v", task, err)
+	}
+}
+
+func TestDestroyVM(t *testing.T) {
+	backend := newFakeProxmox(t)
+	backend.addVM(fakeVM{VmId: 120, Name: "k8s-default-120", Node: "pve", Status: "running"})
+	client := backend.client(t)
+
+	if _, err := DestroyVM(context.Background(), client, 120, 0); err != nil {
+		t.Fatal(err)
+	}
+	if backend.count(`^POST /nodes/pve/qemu/120/status/stop$`) != 1 {
+		t.Fatal("running VM was not stopped")
+	}
+	form := backend.form("DELETE /nodes/pve/qemu/120")
+	if form.Get("purge") != "1" || form.Get("destroy-unreferenced-disks") != "1" {
+		t.Fatalf("delete request = %v", form)
+	}
+	if _, ok := backend.vms[120]; ok {
+		t.Fatal("VM was not deleted")
+	}
+
+	backend.addVM(fakeVM{VmId: 121, Name: "k8s-default-121", Node: "pve"})
+	backend.failTasks = map[string]string{"qmdestroy": "VM is locked (clone)"}
+	if _, err := DestroyVM(context.Background(), client, 121, 0); err == nil || !strings.Contains(err.Error(), "phase "+DESTROY_PHASE_DELETE) {
+		t.Fatalf("DestroyVM() of a locked VM = %v", err)
+	}
+
+	// A VM deleted outside of the autoscaler is already destroyed
+	if _, err := DestroyVM(context.Background(), client, 122, 0); err != nil {
+		t.Fatalf("DestroyVM() of a missing VM = %v", err)
+	}
+	if backend.count(`/qemu/122`) != 0 {
+		t.Fatal("a missing VM was acted on")
+	}
+}
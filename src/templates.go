@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+)
+
+// Result of validating the template of a node group
+type TemplateReport struct {
+	Cluster  string
+	Group    string
+	Template string
+	Node     string
+	Problems []string
+}
+
+/*
+CheckTemplates validates the template
+of every node group before anything
+is cloned. The template must exist,
+be marked as a template, have the
+qemu agent and a cloud-init drive and
+be on each target or fallback node or
+on shared storage so that it can be
+cloned there. A configured HA group
+must exist and contain those nodes.
+Groups use the template and nodes of
+the cluster when it overrides them.
+*/
+func CheckTemplates(client *proxmox.Client, cluster ProxmoxCluster, groups []NodeGroup) ([]TemplateReport, error) {
+	list, err := client.GetVmList()
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := onlineNodes(client)
+	if err != nil {
+		return nil, err
+	}
+	vms, _ := list["data"].([]interface{})
+	var haGroups map[string][]string
+
+	var reports []TemplateReport
+	for _, group := range groups {
+		group := group.onCluster(cluster)
+		report := TemplateReport{Cluster: cluster.Name, Group: group.Name, Template: group.TemplateName, Node: group.NodeName}
+		addProblem := func(problem string) {
+			if !slices.Contains(report.Problems, problem) {
+				report.Problems = append(report.Problems, problem)
+			}
+		}
+		var copies []map[string]interface{}
+		for _, item := range vms {
+			vm, _ := item.(map[string]interface{})
+			if vm["name"] == group.TemplateName && vm["type"] == "qemu" {
+				copies = append(copies, vm)
+			}
+		}
+		if len(copies) == 0 {
+			addProblem("template does not exist")
+		}
+
+		// Every node a VM of the group may be cloned to has to work
+		checked := map[float64]bool{}
+		for i, node := range group.candidateNodes() {
+			role := "target"
+			if i != 0 {
+				role = "fallback"
+			}
+			if !nodes[node] {
+				addProblem(fmt.Sprintf("%s node %s is not online", role, node))
+			}
+			if len(group.HaGroup) != 0 {
+				if haGroups == nil {
+					if haGroups, err = haGroupNodes(client); err != nil {
+						return nil, err
+					}
+				}
+				if problem := checkHaGroup(haGroups, group.HaGroup, node); len(problem) != 0 {
+					addProblem(problem)
+				}
+			}
+			if len(copies) == 0 {
+				continue
+			}
+
+			found := templateCopy(copies, node)
+			id, ok := found["vmid"].(float64)
+			if !ok {
+				addProblem(fmt.Sprintf("template on node %v has no vmid", found["node"]))
+				continue
+			}
+			vmr := proxmox.NewVmRef(int(id))
+			vmr.SetNode(fmt.Sprint(found["node"]))
+			vmr.SetVmType("qemu")
+			config, err := client.GetVmConfig(vmr)
+			if err != nil {
+				addProblem("unable to read the template config: " + err.Error())
+				continue
+			}
+			if !checked[id] {
+				checked[id] = true
+				if isTemplate, _ := found["template"].(float64); isTemplate != 1 {
+					addProblem("VM is not marked as a template")
+				}
+				if agent := fmt.Sprint(config["agent"]); !strings.HasPrefix(agent, "1") && !strings.Contains(agent, "enabled=1") {
+					addProblem("qemu agent is not enabled")
+				}
+				if !hasCloudInitDrive(config) {
+					addProblem("no cloud-init drive is configured")
+				}
+			}
+			if vmr.Node() != node {
+				for _, disk := range vmDisks(config) {
+					status, err := client.GetStorageStatus(vmr, disk.Storage)
+					if err != nil {
+						addProblem(fmt.Sprintf("unable to read storage '%s' of disk %s: %v", disk.Storage, disk.Name, err))
+						continue
+					}
+					if shared, _ := status["shared"].(float64); shared != 1 {
+						addProblem(fmt.Sprintf("template is on node %s and disk %s is on local storage '%s', so it cannot be cloned to %s", vmr.Node(), disk.Name, disk.Storage, node))
+					}
+				}
+			}
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// Prefers the copy of a template on node over the others
+func templateCopy(copies []map[string]interface{}, node string) map[string]interface{} {
+	for _, vm := range copies {
+		if vm["node"] == node {
+			return vm
+		}
+	}
+	return copies[0]
+}
+
+// Returns the names of the proxmox nodes that are online
+func onlineNodes(client *proxmox.Client) (map[string]bool, error) {
+	list, err := client.GetNodeList()
+	if err != nil {
+		return nil, err
+	}
+	nodes := map[string]bool{}
+	items, _ := list["data"].([]interface{})
+	for _, item := range items {
+		node, _ := item.(map[string]interface{})
+		if name, ok := node["node"].(string); ok && node["status"] == "online" {
+			nodes[name] = true
+		}
+	}
+	return nodes, nil
+}
+
+func hasCloudInitDrive(config map[string]interface{}) bool {
+	for key, value := range config {
+		if spec, ok := value.(string); ok && rxDiskKey.MatchString(key) && strings.Contains(spec, "cloudinit") {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+logTemplateReport prints one line per
+node group and the problems found. It
+returns an error if any template can
+not be used.
+*/
+func logTemplateReport(reports []TemplateReport) error {
+	failed := 0
+	for _, report := range reports {
+		if len(report.Problems) == 0 {
+			ColorPrint(INFO, "Template '%s' of group '%s' is ready to clone on node %s of cluster %s", report.Template, report.Group, report.Node, report.Cluster)
+			continue
+		}
+		failed++
+		ColorPrint(WARN, "Template '%s' of group '%s' can not be cloned on node %s of cluster %s:", report.Template, report.Group, report.Node, report.Cluster)
+		for _, problem := range report.Problems {
+			ColorPrint(WARN, "  - %s", problem)
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d node group template(s) failed validation", failed, len(reports))
+	}
+	return nil
+}
+
+/*
+ValidateTemplates checks the templates
+of all node groups on every cluster and
+logs the report. It returns why each
+cluster that is unreachable or has a
+template problem can not take new VMs,
+and an error when no cluster can.
+*/
+func ValidateTemplates(clients map[string]*proxmox.Client, cfg *Config) (map[string]string, error) {
+	unavailable := map[string]string{}
+	for _, cluster := range cfg.Clusters {
+		client := clients[cluster.Name]
+		if client == nil {
+			unavailable[cluster.Name] = "cluster is unreachable"
+			continue
+		}
+		reports, err := CheckTemplates(client, cluster, cfg.NodeGroups)
+		if err == nil {
+			err = logTemplateReport(reports)
+		}
+		if err != nil {
+			unavailable[cluster.Name] = err.Error()
+		}
+	}
+	for _, cluster := range cfg.Clusters {
+		if reason, ok := unavailable[cluster.Name]; ok {
+			ColorPrint(WARN, "Proxmox cluster %s will not get new VMs: %s", cluster.Name, reason)
+		}
+	}
+	if len(unavailable) == len(cfg.Clusters) {
+		return unavailable, errors.New("no proxmox cluster can take new VMs")
+	}
+	return unavailable, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckTemplatesFallbackNodes(t *testing.T) {
+	backend := newFakeProxmox(t)
+	backend.addVM(testTemplate())
+	backend.nodes["pve2"] = fakeNode{MemTotal: 64 << 30, Cpus: 16}
+	client := backend.client(t)
+	group := testConfig().NodeGroups[0]
+	group.NodeName = "pve"
+
+	reports, err := CheckTemplates(client, ProxmoxCluster{Name: DEFAULT_CLUSTER}, []NodeGroup{group})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || len(reports[0].Problems) != 0 {
+		t.Fatalf("reports = %+v, want no problems", reports)
+	}
+
+	// The template is on local storage of pve, so it can not reach the fallbacks
+	group.FallbackNodes = []string{"pve2", "pve3"}
+	reports, err = CheckTemplates(client, ProxmoxCluster{Name: DEFAULT_CLUSTER}, []NodeGroup{group})
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems := strings.Join(reports[0].Problems, "\n")
+	for _, want := range []string{
+		"fallback node pve3 is not online",
+		"cannot be cloned to pve2",
+		"cannot be cloned to pve3",
+	} {
+		if !strings.Contains(problems, want) {
+			t.Errorf("problems do not mention %q:\n%s", want, problems)
+		}
+	}
+	if strings.Contains(problems, "target node") {
+		t.Errorf("the target node was reported:\n%s", problems)
+	}
+}
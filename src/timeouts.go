@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	BACKOFF_BASE = 2 * time.Second
+	BACKOFF_MAX  = 60 * time.Second
+)
+
+/*
+retryWithBackoff calls fn until it
+succeeds or ctx is done. The wait
+between attempts doubles up to
+BACKOFF_MAX and is jittered so that
+parallel provisions do not retry
+in lockstep.
+*/
+func retryWithBackoff(ctx context.Context, action string, fn func() error) error {
+	delay := BACKOFF_BASE
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		ColorPrint(WARN, "%s failed: %v", action, err)
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s: %w (last error: %v)", action, ctx.Err(), err)
+		case <-time.After(wait):
+		}
+		delay *= 2
+		if delay > BACKOFF_MAX {
+			delay = BACKOFF_MAX
+		}
+	}
+}
+
+/*
+runPhase runs fn with a context that
+expires after timeout seconds. An
+expired deadline is reported as a
+terminal failure of the phase.
+*/
+func runPhase(ctx context.Context, phase string, timeout int, fn func(ctx context.Context) error) error {
+	phaseCtx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+	err := fn(phaseCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(phaseCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("phase %s did not finish within %ds: %w", phase, timeout, err)
+	}
+	if err != nil {
+		return fmt.Errorf("phase %s failed: %w", phase, err)
+	}
+	return nil
+}
+
+// Returns a context that is cancelled on SIGTERM or SIGINT
+func shutdownContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+}
+
+/*
+vmContext derives the context of a
+single VM. Once ctx is cancelled the
+VM keeps running for
+shutdownGracePeriod so that it can
+finish or be rolled back cleanly.
+*/
+func (a *Autoscaler) vmContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	vmCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	grace := time.Duration(a.config().ShutdownGracePeriod) * time.Second
+	stop := context.AfterFunc(ctx, func() {
+		ColorPrint(WARN, "Shutdown requested. In-flight VM has %s to finish before it is rolled back", grace)
+		time.AfterFunc(grace, cancel)
+	})
+	return vmCtx, func() {
+		stop()
+		cancel()
+	}
+}
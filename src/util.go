@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"os"
 	"os/exec"
 	"regexp"
@@ -14,7 +15,7 @@ func FailError(err error) {
 }
 
 func getValueOf(key, fallback string) string {
-	value, err := os.ReadFile("/etc/secrets/" + key)
+	value, err := os.ReadFile(SECRETS_PATH + key)
 	if err != nil {
 		return fallback
 	}
@@ -29,13 +30,13 @@ func userRequiresAPIToken(userID string) bool {
 	return rxUserRequiresToken.MatchString(userID)
 }
 
-func sendCommands(user string, addr string, command string) error {
+func sendCommands(ctx context.Context, user string, addr string, command string) error {
 	cmd0 := "ssh"
 	cmd1 := user + "@" + addr
 	cmd2 := "-f"
 
 	commandArr := []string{cmd0, cmd1, cmd2}
-	cmd := exec.Command(commandArr[0], commandArr...)
+	cmd := exec.CommandContext(ctx, commandArr[0], commandArr...)
 	ColorPrint(INFO, "Executing: "+strings.Join(commandArr, " "))
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout